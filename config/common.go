@@ -21,6 +21,17 @@
 
 package config
 
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
 func loadServiceConfiguration(conf Util) (envName, name, version string, startRD, maxRD int64) {
 	if e, ok := conf.GetString("kumuluzee.env.name"); ok {
 		envName = e
@@ -51,6 +62,256 @@ func loadServiceConfiguration(conf Util) (envName, name, version string, startRD
 	return
 }
 
+// extensionNamespace returns the namespace of an extension config source (consul/etcd). Default
+// namespace is derived from service configuration and can be overwritten from configuration file
+// with kumuluzee.config.namespace or kumuluzee.config.<extension>.namespace, or programmatically
+// by passing it into config.Options.
+func extensionNamespace(conf Util, extension string, namespace string, envName, name, version string) string {
+	ns := fmt.Sprintf("environments/%s/services/%s/%s/config", envName, name, version)
+	if n, ok := conf.GetString("kumuluzee.config.namespace"); ok && n != "" {
+		ns = n
+	}
+	if n, ok := conf.GetString("kumuluzee.config." + extension + ".namespace"); ok && n != "" {
+		ns = n
+	}
+	if namespace != "" {
+		ns = namespace
+	}
+	return ns
+}
+
+// stringList returns a list of strings stored under a given key, either as a list or as a
+// comma-separated string. Values are trimmed, while empty and duplicate values are skipped.
+func stringList(conf Util, key string) []string {
+	var values []string
+	if s, ok := conf.GetString(key); ok {
+		values = strings.Split(s, ",")
+	} else if size, ok := conf.GetListSize(key); ok {
+		for i := 0; i < size; i++ {
+			if s, ok := conf.GetString(fmt.Sprintf("%s[%d]", key, i)); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return uniqueStrings(values)
+}
+
+// uniqueStrings returns trimmed, non-empty values, without duplicates
+func uniqueStrings(values []string) []string {
+	found := make(map[string]bool)
+	unique := make([]string, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v != "" && !found[v] {
+			found[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// matches list indices in keys, i.e. [0] in servers[0].host
+var keyIndexRegexp = regexp.MustCompile(`\[(\d+)\]`)
+
+// keyPath converts a configuration key to a path used by key-value stores (Consul, etcd), i.e.
+// servers[0].host is converted to servers/[0]/host
+func keyPath(key string) string {
+	key = keyIndexRegexp.ReplaceAllString(key, ".[$1]")
+	return strings.TrimPrefix(strings.Replace(key, ".", "/", -1), "/")
+}
+
+// listElement is a list element referenced in a key, i.e. servers[2] in servers[2].host is
+// element 2 of list servers
+type listElement struct {
+	list  string
+	index int
+}
+
+// listElements returns list elements referenced in a key, outer lists first, i.e. for key
+// matrix[1][2].value elements 1 of list matrix and 2 of list matrix[1] are returned
+func listElements(key string) []listElement {
+	var elements []listElement
+	for _, m := range keyIndexRegexp.FindAllStringSubmatchIndex(key, -1) {
+		index, err := strconv.Atoi(key[m[2]:m[3]])
+		if err != nil {
+			continue
+		}
+		elements = append(elements, listElement{key[:m[0]], index})
+	}
+	return elements
+}
+
+// splitKeyIndices splits a single part of a dot-delimited key to a name and list indices, i.e.
+// matrix[1][2] is split to matrix and [1 2]
+func splitKeyIndices(part string) (name string, indices []int) {
+	for strings.HasSuffix(part, "]") {
+		open := strings.LastIndex(part, "[")
+		if open < 0 {
+			break
+		}
+		i, err := strconv.Atoi(part[open+1 : len(part)-1])
+		if err != nil || i < 0 {
+			break
+		}
+		indices = append([]int{i}, indices...)
+		part = part[:open]
+	}
+	return part, indices
+}
+
+// listSizeFromPaths returns the number of consecutive list elements of a list on a given path,
+// found in key-value store paths (i.e. path/[0]/host, path/[1]/host)
+func listSizeFromPaths(paths map[string]string, listPath string) (int, bool) {
+	prefix := listPath + "/["
+	indices := make(map[int]bool)
+	for p := range paths {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		rest := p[len(prefix):]
+		end := strings.Index(rest, "]")
+		if end < 0 || (len(rest) > end+1 && rest[end+1] != '/') {
+			continue
+		}
+		if i, err := strconv.Atoi(rest[:end]); err == nil {
+			indices[i] = true
+		}
+	}
+	return consecutiveSize(indices)
+}
+
+// mapKeysFromPaths returns names of direct children of a given path, found in key-value store
+// paths. List elements (i.e. path/[0]) are not included.
+func mapKeysFromPaths(paths map[string]string, mapPath string) []string {
+	prefix := ""
+	if mapPath != "" {
+		prefix = mapPath + "/"
+	}
+
+	found := make(map[string]bool)
+	for p := range paths {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		child := strings.SplitN(p[len(prefix):], "/", 2)[0]
+		if child != "" && !strings.HasPrefix(child, "[") {
+			found[child] = true
+		}
+	}
+
+	keys := make([]string, 0, len(found))
+	for k := range found {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// keysFromPaths returns configuration keys of all key-value store paths equal to or under a
+// given path
+func keysFromPaths(paths map[string]string, prefixPath string) []string {
+	keys := make([]string, 0)
+	for p := range paths {
+		if prefixPath == "" || p == prefixPath || strings.HasPrefix(p, prefixPath+"/") {
+			keys = append(keys, pathKey(p))
+		}
+	}
+	return keys
+}
+
+// pathKey converts a key-value store path to a configuration key, i.e. servers/[0]/host to
+// servers[0].host. It is the inverse of keyPath.
+func pathKey(p string) string {
+	return strings.Replace(strings.Replace(p, "/[", "[", -1), "/", ".", -1)
+}
+
+// childKeys returns names of direct children of a given prefix, found in configuration keys.
+// List elements (i.e. prefix[0]) are not included.
+func childKeys(keys []string, prefix string) []string {
+	if prefix != "" {
+		prefix += "."
+	}
+
+	found := make(map[string]bool)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		child := strings.FieldsFunc(k[len(prefix):], func(r rune) bool {
+			return r == '.' || r == '['
+		})
+		if len(child) > 0 && !strings.HasPrefix(k[len(prefix):], "[") {
+			found[child[0]] = true
+		}
+	}
+	return sortedKeys(found)
+}
+
+// sortedKeys returns keys of a set in ascending order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeMaps returns a copy of high deep-merged with low. Values from high take precedence, nested
+// maps are merged recursively, while lists are not merged.
+func mergeMaps(high, low map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(high)+len(low))
+	for k, v := range low {
+		merged[k] = v
+	}
+	for k, v := range high {
+		hm, highIsMap := v.(map[string]interface{})
+		lm, lowIsMap := merged[k].(map[string]interface{})
+		if highIsMap && lowIsMap {
+			merged[k] = mergeMaps(hm, lm)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// consecutiveSize returns the number of consecutive indices starting with 0
+func consecutiveSize(indices map[int]bool) (int, bool) {
+	size := 0
+	for indices[size] {
+		size++
+	}
+	return size, size > 0
+}
+
+// assertAsInteger returns the value of any integer type as int64
+func assertAsInteger(val interface{}) (num int64, ok bool) {
+	switch t := val.(type) {
+	case int:
+		return int64(t), true
+	case int8:
+		return int64(t), true
+	case int16:
+		return int64(t), true
+	case int32:
+		return int64(t), true
+	case int64:
+		return t, true
+	case uint:
+		return int64(t), true
+	case uint8:
+		return int64(t), true
+	case uint16:
+		return int64(t), true
+	case uint32:
+		return int64(t), true
+	case uint64:
+		return int64(t), true
+	default:
+		return 0, false
+	}
+}
+
 func assertAsNumber(val interface{}) (num float64, ok bool) {
 	switch t := val.(type) {
 	case int:
@@ -82,3 +343,135 @@ func assertAsNumber(val interface{}) (num float64, ok bool) {
 		return 0, false
 	}
 }
+
+// subscriber holds a watch callback along with the key it was registered for
+type subscriber struct {
+	key      string
+	callback func(key string, value string)
+}
+
+// notification is a pending callback invocation with the new value
+type notification struct {
+	subscriber *subscriber
+	value      string
+}
+
+// subscribers maps key paths to subscribers watching them
+type subscribers map[string][]*subscriber
+
+func (m subscribers) add(keyPath string, s *subscriber) {
+	m[keyPath] = append(m[keyPath], s)
+}
+
+func (m subscribers) remove(keyPath string, s *subscriber) {
+	subs := m[keyPath]
+	for i := range subs {
+		if subs[i] == s {
+			m[keyPath] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(m[keyPath]) == 0 {
+		delete(m, keyPath)
+	}
+}
+
+// changed returns notifications for subscribers of keys whose values differ between old and new
+// key-value pairs, including subscribers of parent paths of changed keys (i.e. servers for
+// servers/[0]/host). Deleted keys are notified with an empty value.
+func (m subscribers) changed(old, new map[string]string) []notification {
+	var changedPaths []string
+	for p, oldValue := range old {
+		if newValue, ok := new[p]; !ok || newValue != oldValue {
+			changedPaths = append(changedPaths, p)
+		}
+	}
+	for p := range new {
+		if _, ok := old[p]; !ok {
+			changedPaths = append(changedPaths, p)
+		}
+	}
+
+	var notifications []notification
+	for keyPath, subs := range m {
+		for _, p := range changedPaths {
+			if p == keyPath || strings.HasPrefix(p, keyPath+"/") {
+				for _, s := range subs {
+					notifications = append(notifications, notification{s, new[keyPath]})
+				}
+				break
+			}
+		}
+	}
+	return notifications
+}
+
+func notify(notifications []notification) {
+	for _, n := range notifications {
+		n.subscriber.callback(n.subscriber.key, n.value)
+	}
+}
+
+// valueString formats a configuration value for watch callbacks. Missing value is formatted as
+// an empty string.
+func valueString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// sleepContext pauses for the given duration or until context is done. It returns false if
+// context was done before the duration elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// backoff holds the state of an exponentially increasing retry delay. Delays are in
+// milliseconds, as set by kumuluzee.config.start-retry-delay-ms and max-retry-delay-ms.
+type backoff struct {
+	startDelay int64
+	maxDelay   int64
+	delay      int64
+}
+
+func newBackoff(startDelay, maxDelay int64) *backoff {
+	return &backoff{
+		startDelay: startDelay,
+		maxDelay:   maxDelay,
+		delay:      startDelay,
+	}
+}
+
+// next returns the duration to wait before the next retry and doubles the delay, keeping it at
+// most maxDelay. Returned duration is randomized between half and full current delay, so
+// that multiple watchers don't retry in lockstep.
+func (b *backoff) next() time.Duration {
+	delay := b.delay
+	if delay > 1 {
+		delay = delay/2 + rand.Int63n(delay/2+1)
+	}
+
+	b.delay = b.delay * 2
+	if b.delay > b.maxDelay {
+		b.delay = b.maxDelay
+	}
+	if b.delay < 1 && b.maxDelay > 0 {
+		b.delay = 1
+	}
+
+	return time.Duration(delay) * time.Millisecond
+}
+
+// reset sets the delay back to startDelay after a successful attempt.
+func (b *backoff) reset() {
+	b.delay = b.startDelay
+}
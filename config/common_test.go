@@ -0,0 +1,127 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(100, 1000)
+
+	expected := []int64{100, 200, 400, 800, 1000, 1000}
+	for i := 0; i < 100; i++ {
+		for _, e := range expected {
+			d := b.next()
+			if d < time.Duration(e/2)*time.Millisecond || d > time.Duration(e)*time.Millisecond {
+				t.Errorf("expected delay between %d ms and %d ms, got=%v", e/2, e, d)
+			}
+		}
+		b.reset()
+	}
+}
+
+func TestKeyPath(t *testing.T) {
+	keys := []string{"a", "a.b.c", "servers[0].host", "matrix[1][2]", "l 5.6l"}
+	expected := []string{"a", "a/b/c", "servers/[0]/host", "matrix/[1]/[2]", "l 5/6l"}
+
+	for i, key := range keys {
+		if p := keyPath(key); p != expected[i] {
+			t.Errorf("expected=%v, got=%v", expected[i], p)
+		}
+	}
+}
+
+// stackFrames returns the number of goroutines running a given function and the maximum number
+// of its frames in a single goroutine's stack
+func stackFrames(function string) (goroutines int, maxFrames int) {
+	buf := make([]byte, 1<<22)
+	buf = buf[:runtime.Stack(buf, true)]
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		frames := strings.Count(stack, function+"(")
+		if frames > 0 {
+			goroutines++
+		}
+		if frames > maxFrames {
+			maxFrames = frames
+		}
+	}
+	return
+}
+
+// waitFor polls condition until it is met or timeout is reached
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestChildKeys(t *testing.T) {
+	keys := []string{"a.b", "a.c.d", "a.c[0]", "a[1].e", "ab.f", "g"}
+
+	if c := childKeys(keys, "a"); !reflect.DeepEqual(c, []string{"b", "c"}) {
+		t.Errorf("expected=%v, got=%v", []string{"b", "c"}, c)
+	}
+	if c := childKeys(keys, ""); !reflect.DeepEqual(c, []string{"a", "ab", "g"}) {
+		t.Errorf("expected=%v, got=%v", []string{"a", "ab", "g"}, c)
+	}
+	if p := pathKey(keyPath("servers[0].tags[1]")); p != "servers[0].tags[1]" {
+		t.Errorf("expected=%v, got=%v", "servers[0].tags[1]", p)
+	}
+}
+
+func TestMergeMaps(t *testing.T) {
+	high := map[string]interface{}{
+		"a": "high",
+		"m": map[string]interface{}{"x": 1, "n": map[string]interface{}{"y": 1}},
+		"l": []interface{}{1},
+	}
+	low := map[string]interface{}{
+		"a": "low",
+		"b": "low",
+		"m": map[string]interface{}{"x": 2, "z": 2, "n": map[string]interface{}{"w": 2}},
+		"l": []interface{}{2, 3},
+	}
+	expected := map[string]interface{}{
+		"a": "high",
+		"b": "low",
+		"m": map[string]interface{}{"x": 1, "z": 2, "n": map[string]interface{}{"y": 1, "w": 2}},
+		"l": []interface{}{1},
+	}
+	if merged := mergeMaps(high, low); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected=%v, got=%v", expected, merged)
+	}
+
+	// maps are not modified
+	if len(high) != 3 || len(low["m"].(map[string]interface{})) != 3 {
+		t.Errorf("expected maps to be unmodified, got high=%v, low=%v", high, low)
+	}
+}
@@ -23,9 +23,15 @@
 package config
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/mc0239/logm"
 )
@@ -33,8 +39,10 @@ import (
 // Util is used for retrieving config values from available sources.
 // Util should be initialized with config.NewUtil() function
 type Util struct {
-	configSources []configSource
+	configSources []ConfigSource
 	logger        *logm.Logm
+	ordinals      map[string]int
+	cancel        context.CancelFunc
 }
 
 // Bundle is used for filling a user-defined struct with config values.
@@ -44,98 +52,308 @@ type Bundle struct {
 	fields    interface{}
 	conf      Util
 	Logger    logm.Logm
+
+	// latest snapshot of fields struct, updated atomically on watched changes
+	snapshot *atomic.Value
+	mu       *sync.Mutex
+	atomic   bool
 }
 
 // Options struct is used when instantiating a new Util or Bundle.
 type Options struct {
 	// ConfigPath is a path to configuration file, including the configuration file name.
-	// Passing an empty string will default to config/config.yaml
+	// Passing an empty string will use the path from KUMULUZEE_CONFIG_PATH environment variable
+	// or search for config.yaml (or config.yml) in working directory, config directory,
+	// directory of the executable and /etc/<service-name>, in this order.
 	ConfigPath string
+	// ConfigPaths is a list of configuration files layered on top of the base configuration file
+	// (see ConfigPath), ordered from the highest to the lowest priority. Each file is a separate
+	// configuration source named "file:<path>", with ordinal 100 for the first file, 99 for the
+	// second and so on, while the base file, named "file", has the lowest ordinal. If ConfigPath
+	// is empty and no file is found on the search path, the last file is the base file. Missing
+	// files that are marked as optional, i.e. "optional:override.yaml", are skipped.
+	ConfigPaths []string
 	// Additional configuration source to connect to. Possible values are: "consul", "etcd"
 	Extension string
 	// Additional configuration source's namespace to use (i.e. path prefix). Setting this to a
-	// non-empty value overwrites default namespace or namespace defined in configuration file
+	// non-empty value overwrites default namespace or namespace defined in configuration file.
+	// It only applies to the extension set with Extension.
 	ExtensionNamespace string
+	// Extensions is a list of additional configuration sources to connect to, besides Extension
+	// and extensions listed in kumuluzee.config.extensions. Each extension's namespace can be set
+	// with kumuluzee.config.<extension>.namespace and its ordinal with
+	// kumuluzee.config.<extension>.ordinal in configuration file.
+	Extensions []string
+	// Sources is a list of additional, user-defined configuration sources. They are ordered
+	// together with built-in sources by their ordinal numbers.
+	Sources []ConfigSource
+	// Ordinals overrides ordinal numbers of configuration sources by their names, i.e. "env",
+	// "file", "consul", "etcd" or names of custom sources. Overrides take precedence over
+	// config_ordinal keys defined in configuration sources.
+	Ordinals map[string]int
+	// AtomicUpdates makes Bundle apply watched changes to a copy of the fields struct instead of
+	// the struct itself. The struct passed to NewBundle is only filled once, while updated
+	// values can be safely read from any goroutine with Bundle.Load.
+	AtomicUpdates bool
+	// Context controls the lifetime of watches on configuration sources. When the context is
+	// cancelled, all watches are stopped. Util.Close can be used for the same purpose.
+	Context context.Context
 	// LogLevel can be used to limit the amount of logging output. Default log level is 0. Level 4
 	// will only output Warnings and Errors, and level 5 will only output errors.
 	// See package github.com/mc0239/logm for more details on logging and log levels.
 	LogLevel int
 }
 
-type configSource interface {
+// ConfigSource is a source of configuration values. Besides built-in sources (environment
+// variables, configuration file, Consul and etcd), custom sources can be provided with
+// Options.Sources.
+type ConfigSource interface {
+	// Name returns the name of the configuration source.
 	Name() string
-	ordinal() int
+	// Ordinal returns the default priority of the configuration source. Values from sources with
+	// higher ordinal numbers take precedence over values from sources with lower ones. It can be
+	// overridden with config_ordinal key in the source itself or with Options.Ordinals.
+	Ordinal() int
+	// Get returns the value for a given key or nil, if key does not exist in this source.
 	Get(key string) interface{}
-	Subscribe(key string, callback func(key string, value string))
+	// Subscribe creates a watch on a given key. When value of the key changes, callback is fired
+	// with the key and the new value. Returned Subscription can be used to remove the watch.
+	Subscribe(key string, callback func(key string, value string)) Subscription
+}
+
+// KeyLister is an optional interface, that can be implemented by a ConfigSource to support key
+// enumeration with Util.Keys and Util.GetMapKeys. All built-in configuration sources implement it.
+type KeyLister interface {
+	// Keys returns keys of all values stored under a given prefix, or all keys if prefix is
+	// empty. Keys are returned in the same form as they are passed to Get, i.e. servers[0].host.
+	Keys(prefix string) []string
+}
+
+// Subscription represents a watch created with Subscribe.
+type Subscription interface {
+	// Unsubscribe removes the watch. Callback is not fired for changes that happen afterwards.
+	Unsubscribe()
+}
+
+// SubscriptionFunc is an adapter to allow the use of ordinary functions as a Subscription.
+type SubscriptionFunc func()
+
+// Unsubscribe calls f().
+func (f SubscriptionFunc) Unsubscribe() {
+	f()
+}
+
+// SourceError is returned by NewUtilE and NewBundleE when a configuration source fails to
+// initialize. Source holds the name of the failed configuration source.
+type SourceError struct {
+	Source string
+	Err    error
 }
 
-// NewUtil instantiates a new Util with given options
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("%s configuration source failed to load: %s", e.Source, e.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// NewUtil instantiates a new Util with given options.
+// Configuration sources that fail to initialize are logged and skipped. Use NewUtilE to get
+// an error instead.
 func NewUtil(options Options) Util {
+	k, _ := newUtil(options, false)
+	return k
+}
+
+// NewUtilE instantiates a new Util with given options. If any of the configuration sources fails
+// to initialize, a *SourceError describing the failure is returned.
+func NewUtilE(options Options) (Util, error) {
+	return newUtil(options, true)
+}
+
+func newUtil(options Options, failFast bool) (Util, error) {
 	lgr := logm.New("KumuluzEE-config")
 	lgr.LogLevel = options.LogLevel
 
-	configs := make([]configSource, 0)
+	parent := options.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+
+	configs := make([]ConfigSource, 0)
+
+	envConfigSource := newEnvConfigSource(&lgr)
+	configs = append(configs, envConfigSource)
+
+	// before configuration file is read, service name can only be set with environment variable
+	serviceName, _ := envConfigSource.Get("kumuluzee.name").(string)
 
-	if envConfigSource := newEnvConfigSource(&lgr); envConfigSource != nil {
-		configs = append(configs, envConfigSource)
+	// layered configuration files are followed by the base configuration file
+	files, configPath, err := configFiles(options, serviceName, &lgr)
+	if err != nil {
+		lgr.Error("File configuration source failed to load: %s", err.Error())
+		if failFast {
+			cancel()
+			return Util{}, &SourceError{"file", err}
+		}
 	}
+	for _, f := range files {
+		if f.optional {
+			if _, err := os.Stat(f.path); os.IsNotExist(err) {
+				lgr.Info("Optional configuration file %s not found, skipping", f.path)
+				continue
+			}
+		}
 
-	fileConfigSource := newFileConfigSource(options.ConfigPath, &lgr)
-	if fileConfigSource != nil {
+		fileConfigSource, err := newFileConfigSourceNamed(ctx, f.path, f.name, f.ordinal, &lgr)
+		if err != nil {
+			lgr.Error("Configuration source %s failed to load: %s", f.name, err.Error())
+			if failFast {
+				cancel()
+				return Util{}, &SourceError{f.name, err}
+			}
+			continue
+		}
 		configs = append(configs, fileConfigSource)
-	} else {
-		lgr.Error("File configuration source failed to load!")
+	}
+
+	for _, cs := range options.Sources {
+		if cs != nil {
+			lgr.Verbose("Adding custom config source %s", cs.Name())
+			configs = append(configs, cs)
+		}
+	}
+
+	// copy ordinals, so they can be extended without modifying options
+	ordinals := make(map[string]int, len(options.Ordinals))
+	for name, o := range options.Ordinals {
+		ordinals[name] = o
 	}
 
 	k := Util{
-		configs,
-		&lgr,
+		configSources: configs,
+		logger:        &lgr,
+		ordinals:      ordinals,
+		cancel:        cancel,
 	}
 
 	k.sortConfigSources()
 
-	// use already initialized env/file config util to get values for initialization of extension
-	// config source (consul/etcd)
-	var extConfigSource configSource
-	switch options.Extension {
-	case "consul":
-		extConfigSource = newConsulConfigSource(k, options.ExtensionNamespace, &lgr)
-		break
-	case "etcd":
-		extConfigSource = newEtcdConfigSource(k, options.ExtensionNamespace, &lgr)
-		break
-	case "":
-		// no extension
-		break
-	default:
-		lgr.Error("Invalid extension specified, extension configuration source will not be available")
-		break
+	// profile configuration files override the base file, but not extension config sources;
+	// later profiles override earlier ones
+	for i, profile := range profiles(k) {
+		path := profilePath(configPath, profile)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			lgr.Verbose("Configuration file for profile %s not found on path %s", profile, path)
+			continue
+		}
+
+		ordinal := 110 + i
+		if ordinal > 149 {
+			ordinal = 149
+		}
+		profileConfigSource, err := newProfileConfigSource(ctx, path, profile, ordinal, &lgr)
+		if err != nil {
+			lgr.Error("Configuration file for profile %s failed to load: %s", profile, err.Error())
+			if failFast {
+				cancel()
+				return Util{}, &SourceError{"file:" + profile, err}
+			}
+			continue
+		}
+		k.configSources = append(k.configSources, profileConfigSource)
 	}
 
-	// if extension config source was successfuly initialized, add it to sources and sort again
-	if extConfigSource != nil {
+	k.sortConfigSources()
+
+	// use already initialized env/file/profile config util to get values for initialization of
+	// extension config sources (consul/etcd)
+	base := k
+	base.configSources = append([]ConfigSource(nil), k.configSources...)
+
+	for _, ext := range extensions(options, base) {
+		namespace := ""
+		if ext == options.Extension {
+			namespace = options.ExtensionNamespace
+		}
+
+		extConfigSource, err := newExtensionConfigSource(ctx, base, ext, namespace, &lgr)
+		if err != nil {
+			lgr.Error("Extension configuration source %s will not be available: %s", ext, err.Error())
+			if failFast {
+				cancel()
+				return Util{}, &SourceError{ext, err}
+			}
+			continue
+		}
+
+		// ordinal of an extension can be set in configuration file, unless set in options
+		if _, ok := k.ordinals[ext]; !ok {
+			key := "kumuluzee.config." + ext + ".ordinal"
+			if v := base.getRaw(key); v != nil {
+				if o, ok := parseOrdinal(v); ok {
+					k.ordinals[ext] = o
+				} else {
+					lgr.Warning("Invalid %s %v, ignoring", key, v)
+				}
+			}
+		}
+
+		// if extension config source was successfuly initialized, add it to sources
 		k.configSources = append(k.configSources, extConfigSource)
 	}
 
 	k.sortConfigSources()
 
-	return k
+	return k, nil
 }
 
-// NewBundle fills the given fields struct with values from loaded configuration
+// NewBundle fills the given fields struct with values from loaded configuration.
+// Configuration sources that fail to initialize are logged and skipped. Use NewBundleE to get
+// an error instead.
 func NewBundle(prefixKey string, fields interface{}, options Options) Bundle {
+	return newBundle(prefixKey, fields, NewUtil(options), options)
+}
+
+// NewBundleE fills the given fields struct with values from loaded configuration. If any of the
+// configuration sources fails to initialize, a *SourceError describing the failure is returned.
+// An error is also returned if fields is not a non-nil pointer to a struct.
+func NewBundleE(prefixKey string, fields interface{}, options Options) (Bundle, error) {
+	if v := reflect.ValueOf(fields); v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return Bundle{}, errors.New("fields must be a non-nil pointer to a struct")
+	}
+
+	util, err := NewUtilE(options)
+	if err != nil {
+		return Bundle{}, err
+	}
+	return newBundle(prefixKey, fields, util, options), nil
+}
+
+func newBundle(prefixKey string, fields interface{}, util Util, options Options) Bundle {
 	lgr := logm.New("KumuluzEE-config")
 	lgr.LogLevel = options.LogLevel
 
-	util := NewUtil(options)
-
 	bun := Bundle{
 		prefixKey: prefixKey,
 		fields:    &fields,
 		conf:      util,
 		Logger:    lgr,
+		snapshot:  &atomic.Value{},
+		mu:        &sync.Mutex{},
+		atomic:    options.AtomicUpdates,
 	}
 
+	type watchedField struct {
+		key   string
+		value reflect.Value
+		field reflect.StructField
+	}
+	var watched []watchedField
+
 	traverseStruct(fields, prefixKey,
 		func(key string, value reflect.Value, field reflect.StructField, tags reflect.StructTag) {
 
@@ -147,57 +365,266 @@ func NewBundle(prefixKey string, fields interface{}, options Options) Bundle {
 			if tag, ok := tags.Lookup("config"); ok {
 				tagVals := strings.Split(tag, ",")
 				if len(tagVals) > 1 && tagVals[1] == "watch" {
-					util.Subscribe(key, func(watchKey string, newValue string) {
-						setValueWithReflect(key, value, field, bun)
-						//value.Set(reflect.ValueOf(newValue))
-						lgr.Verbose("Watched value %s updated, new value: %s", key, newValue)
-					})
+					watched = append(watched, watchedField{key, value, field})
 				}
 			}
 
 		},
 	)
 
+	// initial snapshot must be stored before any of the watches fire
+	bun.snapshot.Store(copyStruct(reflect.ValueOf(fields)).Interface())
+
+	for _, w := range watched {
+		w := w
+		util.Subscribe(w.key, func(watchKey string, newValue string) {
+			bun.update(w.key, w.value, w.field)
+			lgr.Verbose("Watched value %s updated, new value: %s", w.key, newValue)
+		})
+	}
+
 	return bun
 }
 
+// Load returns a pointer to the latest snapshot of the fields struct. Snapshot reflects all
+// watched changes applied so far and is never modified afterwards, so it can be safely read from
+// multiple goroutines. Returned value has the same type as fields passed to NewBundle and should
+// not be modified.
+func (b Bundle) Load() interface{} {
+	if b.snapshot == nil {
+		return nil
+	}
+	return b.snapshot.Load()
+}
+
+// update applies a changed value of a watched key to a copy of the latest snapshot and
+// publishes it. Unless Bundle was created with AtomicUpdates, the change is also written to the
+// fields struct directly.
+func (b Bundle) update(key string, value reflect.Value, field reflect.StructField) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	next := copyStruct(reflect.ValueOf(b.snapshot.Load()))
+	traverseStruct(next.Interface(), b.prefixKey,
+		func(k string, v reflect.Value, f reflect.StructField, tags reflect.StructTag) {
+			if k == key {
+				setValueWithReflect(k, v, f, b)
+			}
+		},
+	)
+	b.snapshot.Store(next.Interface())
+
+	if !b.atomic {
+		setValueWithReflect(key, value, field, b)
+	}
+}
+
 // Subscribe creates a watch on a given configuration key.
 // Note that watch will be enabled on an extension configuration source, if one has been defined
 // when Util was created.
-// When value in configuration updates, callback is fired with the key and the new value.
-func (c Util) Subscribe(key string, callback func(key string, value string)) {
+// When the effective value of the key (i.e. the value returned by Get) changes, callback is fired
+// with the key and the new value. Changes in a configuration source, that is overridden by a
+// source with a higher ordinal, don't fire the callback, while a source with a higher ordinal
+// gaining or losing the key does. Callback is also fired when a key, referenced by a property
+// expression in the value, updates. Deleted key is reported with an empty value.
+// Returned Subscription can be used to remove the watch.
+func (c Util) Subscribe(key string, callback func(key string, value string)) Subscription {
+	return c.SubscribeEvent(key, func(event ChangeEvent) {
+		callback(event.Key, event.NewValue)
+	})
+}
+
+// SubscribeEvent creates a watch on a given configuration key. Like with Subscribe, callback is
+// only fired when the effective value of the key changes, but it receives a ChangeEvent with both
+// the old and the new value.
+// Returned Subscription can be used to remove the watch.
+func (c Util) SubscribeEvent(key string, callback func(event ChangeEvent)) Subscription {
+	w := newEventWatch(c, key, callback)
+	refs := newExpressionWatch(c, key, w.changed)
+	sub := c.subscribeSources(key, func(cs ConfigSource, key string, value string) {
+		refs.refresh()
+		w.changed(cs)
+	})
+
+	return SubscriptionFunc(func() {
+		sub.Unsubscribe()
+		refs.Unsubscribe()
+	})
+}
 
-	// find extension configSource and deploy a watch
+// subscribeSources creates a watch on a given key in all configuration sources. Callback receives
+// the configuration source, in which the value has changed.
+func (c Util) subscribeSources(key string, callback func(cs ConfigSource, key string, value string)) Subscription {
+	subscriptions := make([]Subscription, 0, len(c.configSources))
 	for _, cs := range c.configSources {
-		cs.Subscribe(key, callback)
+		cs := cs
+		sub := cs.Subscribe(key, func(key string, value string) {
+			callback(cs, key, value)
+		})
+		if sub != nil {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+
+	return SubscriptionFunc(func() {
+		for _, sub := range subscriptions {
+			sub.Unsubscribe()
+		}
+	})
+}
+
+// Close stops all watches on configuration sources and releases their connections.
+// Util should not be used after it has been closed.
+func (c Util) Close() {
+	if c.cancel != nil {
+		c.cancel()
 	}
+}
 
+// Close stops all watches on Bundle's configuration sources. Watched fields are not updated
+// after Bundle has been closed.
+func (b Bundle) Close() {
+	b.conf.Close()
 }
 
 // Get returns the value for a given key, stored in configuration.
 // Configuration sources are checked by their ordinal numbers, and value is returned from first
-// configuration source it was found in.
+// configuration source it was found in. Maps are merged with maps under the same key from
+// sources with lower ordinal numbers.
+// Property expressions in string values, i.e. ${db.host} or ${db.port:5432}, are resolved
+// through all configuration sources.
 func (c Util) Get(key string) interface{} {
+	return c.resolve(key, c.getRaw(key))
+}
+
+// getResolved returns the value for a given key for typed getters. Values with property
+// expressions that can't be resolved (i.e. circular references) are reported as not found.
+func (c Util) getResolved(key string) (interface{}, bool) {
+	value, err := c.resolveValue(key, c.getRaw(key))
+	return value, err == nil && value != nil
+}
+
+// getRaw returns the value for a given key without resolving property expressions
+func (c Util) getRaw(key string) interface{} {
+	val, _ := c.lookup(key)
+	return val
+}
+
+// lookup returns the value for a given key without resolving property expressions, together
+// with the configuration source it was found in
+func (c Util) lookup(key string) (interface{}, ConfigSource) {
+	sources := c.visibleSources(key)
+
 	// iterate through configSources and try to get some value ...
-	var val interface{}
+	for i, cs := range sources {
+		if val := cs.Get(key); val != nil {
+			// maps (i.e. configuration subtrees) are deep-merged with maps from lower sources
+			if m, ok := val.(map[string]interface{}); ok {
+				for _, lower := range sources[i+1:] {
+					if lm, ok := lower.Get(key).(map[string]interface{}); ok {
+						m = mergeMaps(m, lm)
+					}
+				}
+				val = m
+			}
+			return val, cs
+		}
+	}
+	return nil, nil
+}
 
-	for _, cs := range c.configSources {
-		val = cs.Get(key)
-		if val != nil {
-			break
+// visibleSources returns configuration sources, that can provide a value for a given key. A list
+// defined as a whole (i.e. a YAML sequence) hides the list under the same key in sources with
+// lower ordinals, so for keys of list elements (i.e. servers[2].host) these sources are skipped.
+// If an element is beyond the end of such list, no sources are returned.
+func (c Util) visibleSources(key string) []ConfigSource {
+	sources := c.configSources
+	for _, e := range listElements(key) {
+		for i, cs := range sources {
+			if l, ok := cs.Get(e.list).([]interface{}); ok {
+				if e.index >= len(l) {
+					return nil
+				}
+				sources = sources[:i+1]
+				break
+			}
 		}
 	}
-	return val
+	return sources
+}
+
+// GetListSize returns the number of elements of a list stored under a given key. List elements
+// can be retrieved with indexed keys, i.e. servers[0], servers[1].host.
+// Size is taken from the configuration source with the highest ordinal that defines the whole
+// list (i.e. a YAML sequence), same as the list returned by Get. Sources that define elements
+// with indexed keys (i.e. SERVERS_0_HOST environment variable or servers/[0]/host in Consul) can
+// only override single elements within that size. If no source defines the whole list, the
+// largest size of lists defined with indexed keys is returned.
+// If list is not found in any configuration source, a zero is returned with ok equal to false.
+func (c Util) GetListSize(key string) (size int, ok bool) {
+	for _, cs := range c.visibleSources(key) {
+		if l, isList := cs.Get(key).([]interface{}); isList {
+			return len(l), true
+		}
+		if s, found := sourceListSize(cs, key); found && s > size {
+			size, ok = s, true
+		}
+	}
+	return
+}
+
+// Keys returns sorted keys of all values stored under a given prefix, merged from all
+// configuration sources that implement KeyLister. If prefix is empty, all keys are returned.
+// Keys of list elements are skipped in sources, in which the list is hidden by a whole list (i.e.
+// a YAML sequence) from a source with higher ordinal, same as values returned by Get.
+func (c Util) Keys(prefix string) []string {
+	found := make(map[string]bool)
+	for i, cs := range c.configSources {
+		if kl, ok := cs.(KeyLister); ok {
+			for _, k := range kl.Keys(prefix) {
+				// skip list elements hidden by a list defined in a source with higher ordinal
+				if i < len(c.visibleSources(k)) {
+					found[k] = true
+				}
+			}
+		}
+	}
+	return sortedKeys(found)
+}
+
+// GetMapKeys returns sorted keys of a map (i.e. a configuration subtree) stored under a given
+// prefix, merged from all configuration sources. For prefix tenants and keys tenants.acme.quota
+// and tenants.corp.quota, acme and corp are returned. List elements are not included.
+// If map is not found in any configuration source, nil is returned with ok equal to false.
+func (c Util) GetMapKeys(prefix string) (keys []string, ok bool) {
+	found := make(map[string]bool)
+	for _, cs := range c.visibleSources(prefix) {
+		var sourceKeys []string
+		if ml, ok := cs.(mapKeyLister); ok {
+			sourceKeys = ml.mapKeys(prefix)
+		} else if kl, ok := cs.(KeyLister); ok {
+			sourceKeys = childKeys(kl.Keys(prefix), prefix)
+		}
+		for _, k := range sourceKeys {
+			found[k] = true
+		}
+	}
+
+	if len(found) == 0 {
+		return nil, false
+	}
+	return sortedKeys(found), true
 }
 
 // GetBool is a helper method that calls Util.Get() internally and type asserts the value to
 // bool before returning it.
-// If value is not found in any configuration source or the value could not be type asserted to
-// bool, a false is returned with ok equal to false.
+// If value is not found in any configuration source, its property expressions could not be
+// resolved (i.e. a circular reference) or the value could not be type asserted to bool,
+// a false is returned with ok equal to false.
 func (c Util) GetBool(key string) (value bool, ok bool) {
-	rvalue := c.Get(key)
+	rvalue, _ := c.getResolved(key)
 
-	bvalue, ok := c.Get(key).(bool)
+	bvalue, ok := rvalue.(bool)
 	if ok {
 		return bvalue, true
 	}
@@ -215,10 +642,17 @@ func (c Util) GetBool(key string) (value bool, ok bool) {
 
 // GetInt is a helper method that calls Util.Get() internally and type asserts the value to
 // int before returning it.
-// If value is not found in any configuration source or the value could not be type asserted to
-// int, a zero is returned with ok equal to false.
+// If value is not found in any configuration source, its property expressions could not be
+// resolved (i.e. a circular reference) or the value could not be type asserted to int,
+// a zero is returned with ok equal to false.
 func (c Util) GetInt(key string) (value int, ok bool) {
-	rvalue := c.Get(key)
+	rvalue, _ := c.getResolved(key)
+
+	// try to assert as any integer type first, so that large integers (i.e. int64 from TOML) are
+	// not rounded by a conversion to float64
+	if ivalue, ok := assertAsInteger(rvalue); ok {
+		return int(ivalue), true
+	}
 
 	// try to assert as any number type
 	nvalue, ok := assertAsNumber(rvalue)
@@ -244,10 +678,11 @@ func (c Util) GetInt(key string) (value int, ok bool) {
 
 // GetFloat is a helper method that calls Util.Get() internally and type asserts the value to
 // float64 before returning it.
-// If value is not found in any configuration source or the value could not be type asserted to
-// float64, a zero is returned with ok equal to false.
+// If value is not found in any configuration source, its property expressions could not be
+// resolved (i.e. a circular reference) or the value could not be type asserted to float64,
+// a zero is returned with ok equal to false.
 func (c Util) GetFloat(key string) (value float64, ok bool) {
-	rvalue := c.Get(key)
+	rvalue, _ := c.getResolved(key)
 
 	// try to assert as any number type
 	nvalue, ok := assertAsNumber(rvalue)
@@ -269,11 +704,13 @@ func (c Util) GetFloat(key string) (value float64, ok bool) {
 
 // GetString is a helper method that calls Util.Get() internally and type asserts the value to
 // string before returning it.
-// If value is not found in any configuration source or the value could not be type asserted to
-// string, an empty string is returned with ok equal to false.
+// If value is not found in any configuration source, its property expressions could not be
+// resolved (i.e. a circular reference) or the value could not be type asserted to string,
+// an empty string is returned with ok equal to false.
 func (c Util) GetString(key string) (value string, ok bool) {
 	// try to type assert as string
-	svalue, ok := c.Get(key).(string)
+	rvalue, _ := c.getResolved(key)
+	svalue, ok := rvalue.(string)
 	if ok {
 		return svalue, true
 	}
@@ -282,15 +719,106 @@ func (c Util) GetString(key string) (value string, ok bool) {
 	return "", false
 }
 
+// listSizer is implemented by built-in configuration sources, that can determine the size of a
+// list without probing for each of its elements
+type listSizer interface {
+	listSize(key string) (int, bool)
+}
+
+// mapKeyLister is implemented by built-in configuration sources, that can list keys of a map
+// (i.e. a configuration subtree) more accurately than by parsing keys returned by Keys
+type mapKeyLister interface {
+	mapKeys(prefix string) []string
+}
+
+// sourceListSize returns the size of a list in a given configuration source
+func sourceListSize(cs ConfigSource, key string) (int, bool) {
+	if ls, ok := cs.(listSizer); ok {
+		return ls.listSize(key)
+	}
+	return probeListSize(cs, key)
+}
+
+// probeListSize determines list size of a configuration source by getting its elements until
+// one is not found
+func probeListSize(cs ConfigSource, key string) (int, bool) {
+	if l, ok := cs.Get(key).([]interface{}); ok {
+		return len(l), true
+	}
+
+	size := 0
+	for cs.Get(fmt.Sprintf("%s[%d]", key, size)) != nil {
+		size++
+	}
+	return size, size > 0
+}
+
+// ordinal returns the ordinal number of a configuration source. Ordinal set in Options.Ordinals
+// takes precedence over config_ordinal key defined in the source, which takes precedence over
+// the source's default ordinal.
+func (c Util) ordinal(cs ConfigSource) int {
+	if o, ok := c.ordinals[cs.Name()]; ok {
+		return o
+	}
+
+	if v := cs.Get("config_ordinal"); v != nil {
+		if o, ok := parseOrdinal(v); ok {
+			return o
+		}
+		c.logger.Warning("Invalid config_ordinal %v in %s config source, ignoring", v, cs.Name())
+	}
+	return cs.Ordinal()
+}
+
+// parseOrdinal converts an ordinal number defined in configuration to int
+func parseOrdinal(v interface{}) (int, bool) {
+	if s, ok := v.(string); ok {
+		o, err := strconv.Atoi(strings.TrimSpace(s))
+		return o, err == nil
+	}
+	o, ok := assertAsNumber(v)
+	return int(o), ok
+}
+
+// extensions returns names of extension config sources to initialize: Options.Extension,
+// Options.Extensions and extensions listed in kumuluzee.config.extensions
+func extensions(options Options, conf Util) []string {
+	names := append([]string{options.Extension}, options.Extensions...)
+	return uniqueStrings(append(names, stringList(conf, "kumuluzee.config.extensions")...))
+}
+
+// newExtensionConfigSource initializes an extension config source with a given name
+func newExtensionConfigSource(ctx context.Context, conf Util, extension string, namespace string, lgr *logm.Logm) (ConfigSource, error) {
+	switch extension {
+	case "consul":
+		return newConsulConfigSource(ctx, conf, namespace, lgr)
+	case "etcd":
+		version, err := etcdAPIVersion(conf)
+		if err != nil {
+			return nil, err
+		}
+		if version == 3 {
+			return newEtcd3ConfigSource(ctx, conf, namespace, lgr)
+		}
+		return newEtcdConfigSource(ctx, conf, namespace, lgr)
+	default:
+		return nil, fmt.Errorf("invalid extension specified: %s", extension)
+	}
+}
+
 // sort config sources by ordinal numbers
 func (c Util) sortConfigSources() {
+	ordinals := make([]int, len(c.configSources))
+	for i, cs := range c.configSources {
+		ordinals[i] = c.ordinal(cs)
+	}
+
 	// insertion sort
 	for i := 1; i < len(c.configSources); i++ {
-		for k := i; k > 0 && c.configSources[k].ordinal() > c.configSources[k-1].ordinal(); k-- {
+		for k := i; k > 0 && ordinals[k] > ordinals[k-1]; k-- {
 			// swap
-			temp := c.configSources[k]
-			c.configSources[k] = c.configSources[k-1]
-			c.configSources[k-1] = temp
+			c.configSources[k], c.configSources[k-1] = c.configSources[k-1], c.configSources[k]
+			ordinals[k], ordinals[k-1] = ordinals[k-1], ordinals[k]
 		}
 	}
 }
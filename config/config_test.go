@@ -0,0 +1,302 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type mapConfigSource struct {
+	name   string
+	ord    int
+	values map[string]interface{}
+}
+
+func (c mapConfigSource) Name() string {
+	return c.name
+}
+
+func (c mapConfigSource) Ordinal() int {
+	return c.ord
+}
+
+func (c mapConfigSource) Get(key string) interface{} {
+	return c.values[key]
+}
+
+func (c mapConfigSource) Subscribe(key string, callback func(key string, value string)) Subscription {
+	return SubscriptionFunc(func() {})
+}
+
+func TestCustomConfigSource(t *testing.T) {
+	high := mapConfigSource{"high", 400, map[string]interface{}{
+		"string-value": "from high",
+	}}
+	low := mapConfigSource{"low", 50, map[string]interface{}{
+		"integer-value": 1,
+		"custom-value":  "from low",
+	}}
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{low, high},
+		LogLevel:   100, // turn off logging
+	})
+
+	if s, ok := c.GetString("string-value"); !(ok && s == "from high") {
+		t.Errorf("expected=%v, got=%v", "from high", s)
+	}
+	if i, ok := c.GetInt("integer-value"); !(ok && i == 36) {
+		// file source has higher ordinal than low
+		t.Errorf("expected=%v, got=%v", 36, i)
+	}
+	if s, ok := c.GetString("custom-value"); !(ok && s == "from low") {
+		t.Errorf("expected=%v, got=%v", "from low", s)
+	}
+
+	for i := 1; i < len(c.configSources); i++ {
+		if c.configSources[i-1].Ordinal() < c.configSources[i].Ordinal() {
+			t.Errorf("config sources are not sorted by ordinal: %s before %s",
+				c.configSources[i-1].Name(), c.configSources[i].Name())
+		}
+	}
+}
+
+func TestNewUtilEErrors(t *testing.T) {
+	_, err := NewUtilE(Options{
+		ConfigPath: "../test/does-not-exist.yaml",
+		LogLevel:   100, // turn off logging
+	})
+	if serr, ok := err.(*SourceError); !ok || serr.Source != "file" {
+		t.Errorf("expected file *SourceError, got=%v", err)
+	}
+
+	_, err = NewUtilE(Options{
+		ConfigPath: "../test/config.yaml",
+		Extension:  "zookeeper",
+		LogLevel:   100, // turn off logging
+	})
+	if serr, ok := err.(*SourceError); !ok || serr.Source != "zookeeper" {
+		t.Errorf("expected zookeeper *SourceError, got=%v", err)
+	}
+
+	c, err := NewUtilE(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+	if err != nil {
+		t.Errorf("expected no error, got=%v", err)
+	}
+	if i, ok := c.GetInt("integer-value"); !(ok && i == 36) {
+		t.Errorf("expected=%v, got=%v", 36, i)
+	}
+}
+
+func TestNewBundleEErrors(t *testing.T) {
+	type someConfig struct {
+		Protocol string
+	}
+
+	var sc someConfig
+	if _, err := NewBundleE("some-config", sc, Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	}); err == nil {
+		t.Errorf("expected error for non-pointer fields")
+	}
+
+	if _, err := NewBundleE("some-config", &sc, Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	}); err != nil || sc.Protocol != "tcp" {
+		t.Errorf("expected=%v, got=%v (error: %v)", "tcp", sc.Protocol, err)
+	}
+}
+
+// listingConfigSource is a mapConfigSource, that implements KeyLister
+type listingConfigSource struct {
+	mapConfigSource
+}
+
+func (c listingConfigSource) Keys(prefix string) []string {
+	keys := make([]string, 0)
+	for k := range c.values {
+		if prefix == "" || k == prefix || strings.HasPrefix(k, prefix+".") {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func TestKeys(t *testing.T) {
+	custom := listingConfigSource{mapConfigSource{"custom", 50, map[string]interface{}{
+		"some-config.protocol":   "udp",
+		"some-config.timeout":    30,
+		"some-config.retry.max":  3,
+		"other-config.something": true,
+	}}}
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{custom},
+		LogLevel:   100, // turn off logging
+	})
+
+	expected := []string{
+		"some-config.address.ip",
+		"some-config.address.port",
+		"some-config.protocol",
+		"some-config.retry.max",
+		"some-config.some-boolean",
+		"some-config.timeout",
+		"some-config.version",
+	}
+	if keys := c.Keys("some-config"); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected=%v, got=%v", expected, keys)
+	}
+
+	expected = []string{"address", "protocol", "retry", "some-boolean", "timeout", "version"}
+	if keys, ok := c.GetMapKeys("some-config"); !(ok && reflect.DeepEqual(keys, expected)) {
+		t.Errorf("expected=%v, got=%v", expected, keys)
+	}
+	if keys, ok := c.GetMapKeys("other-config"); !(ok && reflect.DeepEqual(keys, []string{"something"})) {
+		t.Errorf("expected=%v, got=%v", []string{"something"}, keys)
+	}
+	if keys, ok := c.GetMapKeys("string-value"); !(!ok && keys == nil) {
+		// value is not a map
+		t.Errorf("expected=%v, got=%v", nil, keys)
+	}
+
+	expected = []string{
+		"servers[0].host", "servers[0].port",
+		"servers[1].host", "servers[1].port", "servers[1].tags[0]", "servers[1].tags[1]",
+	}
+	if keys := c.Keys("servers"); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected=%v, got=%v", expected, keys)
+	}
+	if keys, ok := c.GetMapKeys("servers"); !(!ok && keys == nil) {
+		// list elements are not map keys
+		t.Errorf("expected=%v, got=%v", nil, keys)
+	}
+}
+
+func TestConfigOrdinal(t *testing.T) {
+	os.Setenv("STRING_VALUE", "from env")
+	defer os.Unsetenv("STRING_VALUE")
+
+	custom := mapConfigSource{"custom", 50, map[string]interface{}{
+		"string-value":   "from custom",
+		"config_ordinal": 500,
+	}}
+	options := Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{custom},
+		LogLevel:   100, // turn off logging
+	}
+
+	// config_ordinal in custom source outranks environment variables
+	c := NewUtil(options)
+	if s, ok := c.GetString("string-value"); !(ok && s == "from custom") {
+		t.Errorf("expected=%v, got=%v", "from custom", s)
+	}
+
+	// Options.Ordinals override config_ordinal
+	options.Ordinals = map[string]int{"custom": 10}
+	c = NewUtil(options)
+	if s, ok := c.GetString("string-value"); !(ok && s == "from env") {
+		t.Errorf("expected=%v, got=%v", "from env", s)
+	}
+
+	// config_ordinal as environment variable applies to environment variables source
+	os.Setenv("CONFIG_ORDINAL", "20")
+	defer os.Unsetenv("CONFIG_ORDINAL")
+	c = NewUtil(options)
+	if s, ok := c.GetString("string-value"); !(ok && s == "hey ho") {
+		t.Errorf("expected=%v, got=%v", "hey ho", s)
+	}
+
+	expected := []string{"file", "env", "custom"}
+	names := make([]string, 0)
+	for _, cs := range c.configSources {
+		names = append(names, cs.Name())
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected=%v, got=%v", expected, names)
+	}
+}
+
+func TestMultipleExtensions(t *testing.T) {
+	consul := newConsulStub(map[string]string{
+		"infra/shared/key": "from consul",
+	})
+	defer consul.server.Close()
+	etcd := newEtcdStub()
+	defer etcd.server.Close()
+
+	c, err := NewUtilE(Options{
+		ConfigPath: "../test/config.yaml",
+		Extensions: []string{"consul"},
+		Sources: []ConfigSource{mapConfigSource{"stub", 50, map[string]interface{}{
+			"kumuluzee.config.extensions":       "etcd, consul",
+			"kumuluzee.config.consul.hosts":     consul.server.URL,
+			"kumuluzee.config.consul.namespace": "infra",
+			"kumuluzee.config.etcd.hosts":       etcd.server.URL,
+			"kumuluzee.config.etcd.namespace":   "team",
+			"kumuluzee.config.etcd.ordinal":     140,
+		}}},
+		LogLevel: 100, // turn off logging
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var names []string
+	for _, cs := range c.configSources {
+		names = append(names, cs.Name())
+		switch s := cs.(type) {
+		case *consulConfigSource:
+			if s.namespace != "infra" {
+				t.Errorf("expected=%v, got=%v", "infra", s.namespace)
+			}
+		case etcdConfigSource:
+			if s.namespace != "team" {
+				t.Errorf("expected=%v, got=%v", "team", s.namespace)
+			}
+		}
+	}
+	expected := []string{"env", "consul", "etcd", "file", "stub"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected=%v, got=%v", expected, names)
+	}
+
+	if s, ok := c.GetString("shared.key"); !(ok && s == "from consul") {
+		t.Errorf("expected=%v, got=%v", "from consul", s)
+	}
+	if s, ok := c.GetString("team.key"); !(ok && strings.HasPrefix(s, "value-")) {
+		// etcd stub answers every key
+		t.Errorf("expected=%v, got=%v", "value-*", s)
+	}
+}
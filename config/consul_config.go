@@ -22,8 +22,8 @@
 package config
 
 import (
+	"context"
 	"fmt"
-	"path"
 	"strings"
 	"time"
 
@@ -38,10 +38,14 @@ type consulConfigSource struct {
 	maxRetryDelay   int64
 	namespace       string
 	logger          *logm.Logm
+
+	*namespaceCache
 }
 
-func newConsulConfigSource(conf Util, namespace string, lgr *logm.Logm) configSource {
-	var consulConfig consulConfigSource
+func newConsulConfigSource(ctx context.Context, conf Util, namespace string, lgr *logm.Logm) (ConfigSource, error) {
+	consulConfig := &consulConfigSource{
+		namespaceCache: newNamespaceCache(),
+	}
 	lgr.Verbose("Initializing %s config source", consulConfig.Name())
 	consulConfig.logger = lgr
 
@@ -49,129 +53,175 @@ func newConsulConfigSource(conf Util, namespace string, lgr *logm.Logm) configSo
 	if addr, ok := conf.GetString("kumuluzee.config.consul.hosts"); ok {
 		consulAddress = addr
 	} else {
-		consulAddress = "http://localhost:8500"
+		// without a scheme, so that http or https is chosen by TLS settings
+		consulAddress = "localhost:8500"
 	}
 
-	if client, err := createConsulClient(consulAddress); err == nil {
-		lgr.Info("Consul client address set to %v", consulAddress)
-		consulConfig.client = client
-	} else {
-		lgr.Error("Failed to create Consul client: %s", err.Error())
+	client, err := createConsulClient(conf, consulAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Consul client: %s", err.Error())
 	}
+	lgr.Info("Consul client address set to %v", consulAddress)
+	consulConfig.client = client
 
 	envName, name, version, startRD, maxRD := loadServiceConfiguration(conf)
 	consulConfig.startRetryDelay = startRD
 	consulConfig.maxRetryDelay = maxRD
 	lgr.Verbose("start-retry-delay-ms=%d, max-retry-delay-ms=%d", consulConfig.startRetryDelay, consulConfig.maxRetryDelay)
 
-	consulConfig.namespace = fmt.Sprintf("environments/%s/services/%s/%s/config", envName, name, version)
-	// namespace can be overwritten from configuration file ...
-	if ns, ok := conf.GetString("kumuluzee.config.namespace"); ok {
-		if ns != "" {
-			consulConfig.namespace = ns
-		}
-	}
-	// ... or programmatically by passing it into config.Options
-	if namespace != "" {
-		consulConfig.namespace = namespace
-	}
+	consulConfig.namespace = extensionNamespace(conf, consulConfig.Name(), namespace, envName, name, version)
 
 	lgr.Info("%s key-value namespace: %s", consulConfig.Name(), consulConfig.namespace)
-	lgr.Verbose("Initialized %s config source", consulConfig.Name())
-	return consulConfig
-}
-
-func (c consulConfigSource) Get(key string) interface{} {
-	//fmt.Println("[consulConfigSource] Get: " + key)
-	kv := c.client.KV()
-
-	key = strings.Replace(key, ".", "/", -1)
-	//fmt.Printf("KV path: %s\n", path.Join(c.namespace, key))
 
-	pair, _, err := kv.Get(path.Join(c.namespace, key), nil)
-	if err != nil {
-		c.logger.Warning("Error getting value: %v", err)
-		return nil
+	// load whole namespace at once, watch will keep local copy up to date afterwards
+	var waitIndex uint64
+	q := (&api.QueryOptions{}).WithContext(ctx)
+	pairs, meta, err := client.KV().List(consulConfig.prefix(), q)
+	if err == nil {
+		consulConfig.values = consulConfig.toValues(pairs)
+		waitIndex = meta.LastIndex
+		lgr.Verbose("Loaded %d keys from %s", len(consulConfig.values), consulConfig.Name())
+	} else {
+		lgr.Warning("Error loading keys from namespace %s: %s", consulConfig.namespace, err.Error())
 	}
+	go consulConfig.watch(ctx, waitIndex)
 
-	//fmt.Printf("Pair received: %v\n", pair)
-	if pair == nil {
-		return nil
-	}
-	// pair.Value is type []byte
-	return string(pair.Value)
+	lgr.Verbose("Initialized %s config source", consulConfig.Name())
+	return consulConfig, nil
 }
 
-func (c consulConfigSource) Subscribe(key string, callback func(key string, value string)) {
+func (c *consulConfigSource) Subscribe(key string, callback func(key string, value string)) Subscription {
 	c.logger.Info("Creating a watch: key=%s. namespace=%s source=%s", key, c.namespace, c.Name())
-	go c.watch(key, "", c.startRetryDelay, callback, 0)
+
+	return c.subscribe(key, callback)
 }
 
-func (c consulConfigSource) Name() string {
+func (c *consulConfigSource) Name() string {
 	return "consul"
 }
 
-func (c consulConfigSource) ordinal() int {
+func (c *consulConfigSource) Ordinal() int {
 	return 150
 }
 
 // functions that aren't configSource methods
 
-func (c consulConfigSource) watch(key string, previousValue string, retryDelay int64, callback func(key string, value string), waitIndex uint64) {
+// watch runs a blocking query on the namespace prefix and updates the local copy of key-value
+// pairs, notifying subscribers of changed keys. Watch stops when context is done.
+func (c *consulConfigSource) watch(ctx context.Context, waitIndex uint64) {
+	retry := newBackoff(c.startRetryDelay, c.maxRetryDelay)
 
-	q := api.QueryOptions{
-		WaitIndex: waitIndex,
-		WaitTime:  10 * time.Minute,
-	}
-
-	key = strings.Replace(key, ".", "/", -1)
-	c.logger.Verbose("Setting a watch on key %s with %s wait time", key, q.WaitTime)
-
-	pair, meta, err := c.client.KV().Get(path.Join(c.namespace, key), &q)
-
-	if err != nil {
-		c.logger.Warning("Watch on %s failed with error: %s, retry delay: %d ms", key, err.Error(), retryDelay)
+	for ctx.Err() == nil {
+		q := api.QueryOptions{
+			WaitIndex: waitIndex,
+			WaitTime:  10 * time.Minute,
+		}
 
-		// sleep for current delay
-		time.Sleep(time.Duration(retryDelay) * time.Millisecond)
+		c.logger.Verbose("Setting a watch on namespace %s with %s wait time", c.namespace, q.WaitTime)
+
+		pairs, meta, err := c.client.KV().List(c.prefix(), q.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			// exponentially extend retry delay, but keep it at most maxRetryDelay
+			retryDelay := retry.next()
+			c.logger.Warning("Watch on %s failed with error: %s, retry delay: %d ms", c.namespace, err.Error(), retryDelay/time.Millisecond)
+
+			// sleep for current delay
+			if !sleepContext(ctx, retryDelay) {
+				break
+			}
+			continue
+		}
+		retry.reset()
 
-		// exponentially extend retry delay, but keep it at most maxRetryDelay
-		newRetryDelay := retryDelay * 2
-		if newRetryDelay > c.maxRetryDelay {
-			newRetryDelay = c.maxRetryDelay
+		if meta.LastIndex == waitIndex {
+			c.logger.Verbose("Wait time (%s) on watch for namespace %s reached.", q.WaitTime, c.namespace)
+			continue
+		}
+		// index can go backwards (i.e. when Consul's state is restored), start over in this case
+		if meta.LastIndex < waitIndex {
+			waitIndex = 0
+		} else {
+			waitIndex = meta.LastIndex
 		}
-		c.watch(key, "", newRetryDelay, callback, 0)
-		return
+
+		c.update(c.toValues(pairs))
 	}
 
-	c.logger.Verbose("Wait time (%s) on watch for key %s reached.", q.WaitTime, key)
+	c.logger.Verbose("Watch on namespace %s stopped", c.namespace)
+}
 
-	if pair != nil {
-		if string(pair.Value) != previousValue {
-			callback(key, string(pair.Value))
-		}
-		c.watch(key, string(pair.Value), c.startRetryDelay, callback, meta.LastIndex)
-	} else {
-		if previousValue != "" {
-			callback(key, "")
-		}
-		var lastIndex uint64
-		if meta != nil {
-			lastIndex = meta.LastIndex
+func (c *consulConfigSource) prefix() string {
+	return strings.TrimSuffix(c.namespace, "/") + "/"
+}
+
+func (c *consulConfigSource) toValues(pairs api.KVPairs) map[string]string {
+	prefix := c.prefix()
+	values := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		// skip folders
+		if strings.HasSuffix(pair.Key, "/") {
+			continue
 		}
-		c.watch(key, "", c.startRetryDelay, callback, lastIndex)
+		// pair.Value is type []byte
+		values[strings.TrimPrefix(pair.Key, prefix)] = string(pair.Value)
 	}
+	return values
 }
 
 // functions that aren't configSource methods or etcdCondigSource methods
 
-func createConsulClient(address string) (*api.Client, error) {
+// createConsulClient creates a Consul client for a given address. ACL token, datacenter and TLS
+// settings are read from kumuluzee.config.consul namespace in configuration.
+func createConsulClient(conf Util, address string) (*api.Client, error) {
 	clientConfig := api.DefaultConfig()
 	clientConfig.Address = address
 
+	if token, ok := conf.GetString("kumuluzee.config.consul.token"); ok {
+		clientConfig.Token = token
+	}
+	if datacenter, ok := conf.GetString("kumuluzee.config.consul.datacenter"); ok {
+		clientConfig.Datacenter = datacenter
+	}
+
+	useTLS := false
+	if caFile, ok := conf.GetString("kumuluzee.config.consul.tls.ca-file"); ok {
+		clientConfig.TLSConfig.CAFile = caFile
+		useTLS = true
+	}
+	if certFile, ok := conf.GetString("kumuluzee.config.consul.tls.cert-file"); ok {
+		clientConfig.TLSConfig.CertFile = certFile
+		useTLS = true
+	}
+	if keyFile, ok := conf.GetString("kumuluzee.config.consul.tls.key-file"); ok {
+		clientConfig.TLSConfig.KeyFile = keyFile
+		useTLS = true
+	}
+	if skip, ok := conf.GetBool("kumuluzee.config.consul.tls.insecure-skip-verify"); ok {
+		clientConfig.TLSConfig.InsecureSkipVerify = skip
+		useTLS = true
+	}
+	clientConfig.Scheme, clientConfig.Address = consulScheme(address, useTLS)
+
 	client, err := api.NewClient(clientConfig)
 	if err != nil {
 		return nil, err
 	}
 	return client, nil
 }
+
+// consulScheme splits a Consul address to a scheme and an address without it. Scheme in address
+// (i.e. http://localhost:8500) takes precedence, otherwise https is used if TLS is configured.
+// Scheme is always set explicitly, since Consul clients of different versions handle schemes in
+// addresses differently when TLS is configured.
+func consulScheme(address string, useTLS bool) (scheme string, host string) {
+	if parts := strings.SplitN(address, "://", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	if useTLS {
+		return "https", address
+	}
+	return "http", address
+}
@@ -22,7 +22,23 @@
 package config
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func consulAssert(t *testing.T, expected interface{}, got interface{}) {
@@ -155,3 +171,628 @@ func TestConsulConfigDeep(t *testing.T) {
 		consulAssert(t, 6, i)
 	}
 }
+
+// consulStub is a minimal Consul KV HTTP API, supporting recursive and blocking queries
+type consulStub struct {
+	mu       sync.Mutex
+	index    uint64
+	values   map[string]string
+	changed  chan struct{}
+	requests int
+	server   *httptest.Server
+
+	// ACL token, datacenter and number of client certificates of the last request
+	token       string
+	datacenter  string
+	clientCerts int
+
+	// noBlock makes every query return immediately with a new index
+	noBlock bool
+	// fail makes every query fail with an internal server error
+	fail bool
+}
+
+func newConsulStub(values map[string]string) *consulStub {
+	s := &consulStub{
+		index:   1,
+		values:  values,
+		changed: make(chan struct{}),
+	}
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+// newConsulTLSStub starts a consulStub over HTTPS, requesting (but not verifying) client
+// certificates
+func newConsulTLSStub(values map[string]string) *consulStub {
+	s := &consulStub{
+		index:   1,
+		values:  values,
+		changed: make(chan struct{}),
+	}
+	s.server = httptest.NewUnstartedServer(s)
+	s.server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	// handshakes with untrusted certificates are expected
+	s.server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.server.StartTLS()
+	return s
+}
+
+func (s *consulStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	_, recurse := r.URL.Query()["recurse"]
+	waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+	s.mu.Lock()
+	s.requests++
+	s.token = r.Header.Get("X-Consul-Token")
+	s.datacenter = r.URL.Query().Get("dc")
+	if r.TLS != nil {
+		s.clientCerts = len(r.TLS.PeerCertificates)
+	}
+	if s.fail {
+		s.mu.Unlock()
+		http.Error(w, "stub failure", http.StatusInternalServerError)
+		return
+	}
+	if s.noBlock {
+		s.index++
+	}
+	if waitIndex != 0 && waitIndex == s.index {
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+		s.mu.Lock()
+	}
+
+	type pair struct {
+		Key   string
+		Value []byte
+	}
+	pairs := make([]pair, 0)
+	for k, v := range s.values {
+		if k == key || (recurse && strings.HasPrefix(k, key)) {
+			pairs = append(pairs, pair{k, []byte(v)})
+		}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	s.mu.Unlock()
+
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func (s *consulStub) set(key, value string, deleted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if deleted {
+		delete(s.values, key)
+	} else {
+		s.values[key] = value
+	}
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *consulStub) setMode(noBlock bool, fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noBlock = noBlock
+	s.fail = fail
+}
+
+func (s *consulStub) lastRequest() (token string, datacenter string, clientCerts int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token, s.datacenter, s.clientCerts
+}
+
+func (s *consulStub) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func consulStubOptions(s *consulStub) Options {
+	return Options{
+		Extension:          "consul",
+		ExtensionNamespace: "test",
+		Sources: []ConfigSource{mapConfigSource{"stub", 50, map[string]interface{}{
+			"kumuluzee.config.consul.hosts": s.server.URL,
+		}}},
+		LogLevel: 100, // turn off logging
+	}
+}
+
+func TestConsulConfigCache(t *testing.T) {
+	stub := newConsulStub(map[string]string{
+		"test/some-config/protocol":   "tcp",
+		"test/some-config/address/ip": "127.0.0.2",
+		"test-other/protocol":         "udp",
+	})
+	defer stub.server.Close()
+
+	c := NewUtil(consulStubOptions(stub))
+	defer c.Close()
+
+	requests := stub.requestCount()
+	for i := 0; i < 100; i++ {
+		if s, ok := c.GetString("some-config.protocol"); !(ok && s == "tcp") {
+			consulAssert(t, "tcp", s)
+		}
+	}
+	if v := c.Get("protocol"); v != nil {
+		consulAssert(t, nil, v)
+	}
+	if stub.requestCount() > requests+1 {
+		// only the background watch may query the stub in the meantime
+		t.Errorf("Get should be served from local cache, got %d requests", stub.requestCount()-requests)
+	}
+
+	updates := make(chan string, 10)
+	c.Subscribe("some-config.protocol", func(key string, value string) {
+		updates <- key + "=" + value
+	})
+	c.Subscribe("some-config.address.ip", func(key string, value string) {
+		updates <- key + "=" + value
+	})
+
+	stub.set("test/some-config/protocol", "udp", false)
+	select {
+	case u := <-updates:
+		if u != "some-config.protocol=udp" {
+			consulAssert(t, "some-config.protocol=udp", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch was not fired")
+	}
+	if s, _ := c.GetString("some-config.protocol"); s != "udp" {
+		consulAssert(t, "udp", s)
+	}
+
+	stub.set("test/some-config/address/ip", "", true)
+	select {
+	case u := <-updates:
+		if u != "some-config.address.ip=" {
+			consulAssert(t, "some-config.address.ip=", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch was not fired")
+	}
+	if v := c.Get("some-config.address.ip"); v != nil {
+		consulAssert(t, nil, v)
+	}
+}
+
+func TestConsulConfigClose(t *testing.T) {
+	stub := newConsulStub(map[string]string{
+		"test/string-value": "hey ho",
+	})
+	defer stub.server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	options := consulStubOptions(stub)
+	options.Context = ctx
+	c := NewUtil(options)
+
+	updates := make(chan string, 10)
+	sub := c.Subscribe("string-value", func(key string, value string) {
+		updates <- value
+	})
+
+	stub.set("test/string-value", "lets go", false)
+	select {
+	case <-updates:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch was not fired")
+	}
+
+	sub.Unsubscribe()
+	stub.set("test/string-value", "hey ho", false)
+	select {
+	case u := <-updates:
+		t.Errorf("watch fired after unsubscribe with value %s", u)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	cancel()
+	// wait for in-flight blocking query to return
+	time.Sleep(200 * time.Millisecond)
+	requests := stub.requestCount()
+	time.Sleep(300 * time.Millisecond)
+	if stub.requestCount() != requests {
+		t.Errorf("watch is still running after context was cancelled")
+	}
+}
+
+func TestConsulConfigWatchIterations(t *testing.T) {
+	stub := newConsulStub(map[string]string{
+		"test/string-value": "hey ho",
+	})
+	defer stub.server.Close()
+
+	options := consulStubOptions(stub)
+	options.Sources = append(options.Sources, mapConfigSource{"delays", 60, map[string]interface{}{
+		"kumuluzee.config.start-retry-delay-ms": 1,
+		"kumuluzee.config.max-retry-delay-ms":   2,
+	}})
+	c := NewUtil(options)
+	defer c.Close()
+
+	updates := make(chan string, 10)
+	c.Subscribe("string-value", func(key string, value string) {
+		updates <- value
+	})
+
+	// thousands of blocking queries returning with a new index and no changes
+	stub.setMode(true, false)
+	requests := stub.requestCount()
+	if !waitFor(30*time.Second, func() bool { return stub.requestCount() > requests+3000 }) {
+		t.Fatalf("watch did not reach 3000 iterations")
+	}
+	if _, f := stackFrames("(*consulConfigSource).watch"); f != 1 {
+		t.Errorf("expected a single watch frame, got=%d", f)
+	}
+
+	// thousands of failed queries
+	stub.setMode(false, true)
+	requests = stub.requestCount()
+	if !waitFor(30*time.Second, func() bool { return stub.requestCount() > requests+1000 }) {
+		t.Fatalf("watch did not retry 1000 times")
+	}
+	if _, f := stackFrames("(*consulConfigSource).watch"); f != 1 {
+		t.Errorf("expected a single watch frame, got=%d", f)
+	}
+
+	// watch recovers and still delivers changes
+	stub.setMode(false, false)
+	stub.set("test/string-value", "lets go", false)
+	select {
+	case u := <-updates:
+		if u != "lets go" {
+			consulAssert(t, "lets go", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch was not fired")
+	}
+
+	watches, _ := stackFrames("(*consulConfigSource).watch")
+	c.Close()
+	if !waitFor(5*time.Second, func() bool {
+		g, _ := stackFrames("(*consulConfigSource).watch")
+		return g == watches-1
+	}) {
+		t.Errorf("watch goroutine did not stop")
+	}
+}
+
+func TestConsulConfigBundleAtomic(t *testing.T) {
+	type someConfig struct {
+		Protocol string `config:"protocol,watch"`
+		Port     int    `config:"port,watch"`
+	}
+
+	stub := newConsulStub(map[string]string{
+		"test/some-config/protocol": "tcp",
+		"test/some-config/port":     "3000",
+	})
+	defer stub.server.Close()
+
+	options := consulStubOptions(stub)
+	options.AtomicUpdates = true
+
+	sc := someConfig{}
+	bun := NewBundle("some-config", &sc, options)
+	defer bun.Close()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snapshot := bun.Load().(*someConfig)
+				if snapshot.Protocol == "" || snapshot.Port == 0 {
+					t.Errorf("inconsistent snapshot: %v", *snapshot)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 20; i++ {
+		stub.set("test/some-config/port", strconv.Itoa(3000+i), false)
+	}
+	stub.set("test/some-config/protocol", "udp", false)
+
+	ok := waitFor(5*time.Second, func() bool {
+		snapshot := bun.Load().(*someConfig)
+		return snapshot.Protocol == "udp" && snapshot.Port == 3020
+	})
+	close(done)
+	wg.Wait()
+
+	if !ok {
+		consulAssert(t, someConfig{"udp", 3020}, *bun.Load().(*someConfig))
+	}
+	if sc.Protocol != "tcp" || sc.Port != 3000 {
+		// fields struct is not updated by watches
+		consulAssert(t, someConfig{"tcp", 3000}, sc)
+	}
+}
+
+func TestConsulConfigList(t *testing.T) {
+	stub := newConsulStub(map[string]string{
+		"test/servers/[0]/host":     "10.0.0.1",
+		"test/servers/[1]/host":     "10.0.0.2",
+		"test/servers/[1]/tags/[0]": "primary",
+		"test/servers-other/[2]":    "x",
+	})
+	defer stub.server.Close()
+
+	c := NewUtil(consulStubOptions(stub))
+	defer c.Close()
+
+	if s, ok := c.GetString("servers[1].host"); !(ok && s == "10.0.0.2") {
+		consulAssert(t, "10.0.0.2", s)
+	}
+	if s, ok := c.GetString("servers[1].tags[0]"); !(ok && s == "primary") {
+		consulAssert(t, "primary", s)
+	}
+	if n, ok := c.GetListSize("servers"); !(ok && n == 2) {
+		consulAssert(t, 2, n)
+	}
+	if n, ok := c.GetListSize("servers[1].tags"); !(ok && n == 1) {
+		consulAssert(t, 1, n)
+	}
+	if n, ok := c.GetListSize("servers-other"); !(!ok && n == 0) {
+		consulAssert(t, 0, n)
+	}
+}
+
+func TestConsulConfigBundleListWatch(t *testing.T) {
+	type listConfig struct {
+		Servers []string `config:"servers,watch"`
+	}
+
+	stub := newConsulStub(map[string]string{
+		"test/list-config/servers/[0]": "10.0.0.1",
+		"test/list-config/servers/[1]": "10.0.0.2",
+	})
+	defer stub.server.Close()
+
+	options := consulStubOptions(stub)
+	options.AtomicUpdates = true
+
+	var lc listConfig
+	bun := NewBundle("list-config", &lc, options)
+	defer bun.Close()
+
+	if !reflect.DeepEqual(lc.Servers, []string{"10.0.0.1", "10.0.0.2"}) {
+		consulAssert(t, []string{"10.0.0.1", "10.0.0.2"}, lc.Servers)
+	}
+
+	stub.set("test/list-config/servers/[2]", "10.0.0.3", false)
+	if !waitFor(5*time.Second, func() bool {
+		return len(bun.Load().(*listConfig).Servers) == 3
+	}) {
+		consulAssert(t, 3, len(bun.Load().(*listConfig).Servers))
+	}
+
+	stub.set("test/list-config/servers/[0]", "10.0.0.4", false)
+	if !waitFor(5*time.Second, func() bool {
+		return bun.Load().(*listConfig).Servers[0] == "10.0.0.4"
+	}) {
+		consulAssert(t, "10.0.0.4", bun.Load().(*listConfig).Servers[0])
+	}
+}
+
+func TestConsulConfigBundleMapWatch(t *testing.T) {
+	type mapConfig struct {
+		Quotas map[string]int `config:"quotas,watch"`
+	}
+
+	stub := newConsulStub(map[string]string{
+		"test/map-config/quotas/acme": "100",
+		"test/map-config/quotas/corp": "250",
+	})
+	defer stub.server.Close()
+
+	options := consulStubOptions(stub)
+	options.AtomicUpdates = true
+
+	var mc mapConfig
+	bun := NewBundle("map-config", &mc, options)
+	defer bun.Close()
+
+	if !reflect.DeepEqual(mc.Quotas, map[string]int{"acme": 100, "corp": 250}) {
+		consulAssert(t, map[string]int{"acme": 100, "corp": 250}, mc.Quotas)
+	}
+
+	stub.set("test/map-config/quotas/globex", "50", false)
+	if !waitFor(5*time.Second, func() bool {
+		return bun.Load().(*mapConfig).Quotas["globex"] == 50
+	}) {
+		consulAssert(t, 50, bun.Load().(*mapConfig).Quotas["globex"])
+	}
+
+	stub.set("test/map-config/quotas/acme", "", true)
+	if !waitFor(5*time.Second, func() bool {
+		_, ok := bun.Load().(*mapConfig).Quotas["acme"]
+		return !ok
+	}) {
+		consulAssert(t, map[string]int{"corp": 250, "globex": 50}, bun.Load().(*mapConfig).Quotas)
+	}
+}
+
+func TestConsulConfigKeys(t *testing.T) {
+	stub := newConsulStub(map[string]string{
+		"test/routes/users/url":      "http://users",
+		"test/routes/orders/[0]/url": "http://orders",
+		"test-other/routes/x/url":    "http://other",
+	})
+	defer stub.server.Close()
+
+	c := NewUtil(consulStubOptions(stub))
+	defer c.Close()
+
+	expected := []string{"routes.orders[0].url", "routes.users.url"}
+	if keys := c.Keys("routes"); !reflect.DeepEqual(keys, expected) {
+		consulAssert(t, expected, keys)
+	}
+	if keys, ok := c.GetMapKeys("routes"); !(ok && reflect.DeepEqual(keys, []string{"orders", "users"})) {
+		consulAssert(t, []string{"orders", "users"}, keys)
+	}
+
+	stub.set("test/routes/billing/url", "http://billing", false)
+	if !waitFor(5*time.Second, func() bool {
+		keys, _ := c.GetMapKeys("routes")
+		return len(keys) == 3
+	}) {
+		keys, _ := c.GetMapKeys("routes")
+		consulAssert(t, []string{"billing", "orders", "users"}, keys)
+	}
+}
+
+// writeServerCertificate writes test server's certificate and private key to PEM files
+func writeServerCertificate(t *testing.T, server *httptest.Server, dir string) (certFile string, keyFile string) {
+	cert := server.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestConsulConfigTLS(t *testing.T) {
+	stub := newConsulTLSStub(map[string]string{
+		"test/tls-config/protocol": "tcp",
+	})
+	defer stub.server.Close()
+
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeServerCertificate(t, stub.server, dir)
+
+	// stub's certificate is issued for 127.0.0.1, address is used without a scheme
+	address := strings.TrimPrefix(stub.server.URL, "https://")
+	newUtil := func(values map[string]interface{}) (Util, error) {
+		values["kumuluzee.config.consul.hosts"] = address
+		return NewUtilE(Options{
+			ConfigPath:         "../test/config.yaml",
+			Extension:          "consul",
+			ExtensionNamespace: "test",
+			Sources:            []ConfigSource{mapConfigSource{"stub", 50, values}},
+			LogLevel:           100, // turn off logging
+		})
+	}
+
+	c, err := newUtil(map[string]interface{}{
+		"kumuluzee.config.consul.token":         "secret-token",
+		"kumuluzee.config.consul.datacenter":    "dc2",
+		"kumuluzee.config.consul.tls.ca-file":   certFile,
+		"kumuluzee.config.consul.tls.cert-file": certFile,
+		"kumuluzee.config.consul.tls.key-file":  keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := c.GetString("tls-config.protocol"); !(ok && s == "tcp") {
+		consulAssert(t, "tcp", s)
+	}
+	c.Close()
+	if token, datacenter, clientCerts := stub.lastRequest(); token != "secret-token" || datacenter != "dc2" || clientCerts != 1 {
+		t.Errorf("expected token=secret-token dc=dc2 certs=1, got token=%s dc=%s certs=%d", token, datacenter, clientCerts)
+	}
+
+	// server certificate is not trusted without CA
+	c, err = newUtil(map[string]interface{}{
+		"kumuluzee.config.consul.tls.cert-file": certFile,
+		"kumuluzee.config.consul.tls.key-file":  keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := c.Get("tls-config.protocol"); v != nil {
+		consulAssert(t, nil, v)
+	}
+	c.Close()
+
+	c, err = newUtil(map[string]interface{}{
+		"kumuluzee.config.consul.tls.insecure-skip-verify": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := c.GetString("tls-config.protocol"); !(ok && s == "tcp") {
+		consulAssert(t, "tcp", s)
+	}
+	c.Close()
+
+	// explicit http scheme disables TLS
+	address = "http://" + address
+	c, err = newUtil(map[string]interface{}{
+		"kumuluzee.config.consul.tls.insecure-skip-verify": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := c.Get("tls-config.protocol"); v != nil {
+		consulAssert(t, nil, v)
+	}
+	c.Close()
+
+	_, err = newUtil(map[string]interface{}{
+		"kumuluzee.config.consul.tls.ca-file": filepath.Join(dir, "missing.pem"),
+	})
+	if serr, ok := err.(*SourceError); !ok || serr.Source != "consul" {
+		consulAssert(t, "consul source error", err)
+	}
+}
+
+func TestConsulScheme(t *testing.T) {
+	addresses := []struct {
+		address string
+		useTLS  bool
+		scheme  string
+		host    string
+	}{
+		{"localhost:8500", false, "http", "localhost:8500"},
+		{"localhost:8500", true, "https", "localhost:8500"},
+		{"http://consul:8500", true, "http", "consul:8500"},
+		{"https://consul:8501", false, "https", "consul:8501"},
+	}
+	for _, a := range addresses {
+		if scheme, host := consulScheme(a.address, a.useTLS); scheme != a.scheme || host != a.host {
+			t.Errorf("address=%s tls=%v: expected=%s://%s, got=%s://%s", a.address, a.useTLS, a.scheme, a.host, scheme, host)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ghodss/yaml"
+)
+
+// Decoder decodes contents of a configuration file. Nested objects must be decoded to
+// map[string]interface{} and lists to []interface{}, so that values can be retrieved with keys
+// like some-config.servers[0].host.
+type Decoder func(data []byte) (map[string]interface{}, error)
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = map[string]Decoder{
+		"yaml":       decodeYAML,
+		"yml":        decodeYAML,
+		"json":       decodeJSON,
+		"properties": decodeProperties,
+		"toml":       decodeTOML,
+	}
+)
+
+// RegisterDecoder registers a decoder for configuration files with a given extension, i.e.
+// "conf" or ".conf". Extensions are matched case insensitively. Registering a decoder for an
+// already registered extension replaces it. Decoders for yaml, yml, json and toml extensions
+// are registered by default, as well as a decoder for Java .properties files.
+func RegisterDecoder(extension string, decoder Decoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+
+	decoders[normalizeExtension(extension)] = decoder
+}
+
+// decoderFor returns the decoder for a given configuration file, chosen by its extension. Files
+// without an extension are decoded as YAML.
+func decoderFor(path string) (Decoder, error) {
+	ext := normalizeExtension(filepath.Ext(path))
+	if ext == "" {
+		return decodeYAML, nil
+	}
+
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+
+	decoder, ok := decoders[ext]
+	if !ok {
+		registered := make(map[string]bool, len(decoders))
+		for e := range decoders {
+			registered[e] = true
+		}
+		return nil, fmt.Errorf("unknown configuration file extension %s of file %s, supported extensions are: %s (see RegisterDecoder)",
+			ext, path, strings.Join(sortedKeys(registered), ", "))
+	}
+	return decoder, nil
+}
+
+func normalizeExtension(extension string) string {
+	return strings.ToLower(strings.TrimPrefix(extension, "."))
+}
+
+func decodeYAML(data []byte) (map[string]interface{}, error) {
+	var config map[string]interface{}
+	err := yaml.Unmarshal(data, &config)
+	return config, err
+}
+
+func decodeJSON(data []byte) (map[string]interface{}, error) {
+	var config map[string]interface{}
+	err := json.Unmarshal(data, &config)
+	return config, err
+}
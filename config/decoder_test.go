@@ -0,0 +1,108 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONConfigFile(t *testing.T) {
+	c, err := NewUtilE(Options{
+		ConfigPath: "../test/config.json",
+		LogLevel:   100, // turn off logging
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i, ok := c.GetInt("integer-value"); !(ok && i == 36) {
+		t.Errorf("expected=%v, got=%v", 36, i)
+	}
+	if b, ok := c.GetBool("boolean-value"); !(ok && b) {
+		t.Errorf("expected=%v, got=%v", true, b)
+	}
+	if s, ok := c.GetString("some-config.address.ip"); !(ok && s == "127.0.0.2") {
+		t.Errorf("expected=%v, got=%v", "127.0.0.2", s)
+	}
+	if i, ok := c.GetInt("servers[1].port"); !(ok && i == 8081) {
+		t.Errorf("expected=%v, got=%v", 8081, i)
+	}
+}
+
+func TestUnknownConfigFileExtension(t *testing.T) {
+	_, err := NewUtilE(Options{
+		ConfigPath: "../test/config.conf",
+		LogLevel:   100, // turn off logging
+	})
+	serr, ok := err.(*SourceError)
+	if !ok || serr.Source != "file" {
+		t.Fatalf("expected file source error, got=%v", err)
+	}
+	if !strings.Contains(serr.Error(), "unknown configuration file extension conf") ||
+		!strings.Contains(serr.Error(), "json, properties, toml, yaml, yml") {
+		t.Errorf("unexpected error: %v", serr)
+	}
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	// decodes lines of key=value pairs
+	RegisterDecoder(".KV", func(data []byte) (map[string]interface{}, error) {
+		config := make(map[string]interface{})
+		for _, line := range strings.Split(string(data), "\n") {
+			if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+				config[kv[0]] = kv[1]
+			}
+		}
+		return config, nil
+	})
+	defer func() {
+		decodersMu.Lock()
+		delete(decoders, "kv")
+		decodersMu.Unlock()
+	}()
+
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.kv")
+	if err := ioutil.WriteFile(path, []byte("a=1\nb=two\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewUtilE(Options{
+		ConfigPath: path,
+		LogLevel:   100, // turn off logging
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := c.GetString("b"); !(ok && s == "two") {
+		t.Errorf("expected=%v, got=%v", "two", s)
+	}
+}
@@ -22,8 +22,10 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/mc0239/logm"
@@ -32,7 +34,7 @@ import (
 type envConfigSource struct {
 }
 
-func newEnvConfigSource(lgr *logm.Logm) configSource {
+func newEnvConfigSource(lgr *logm.Logm) ConfigSource {
 	var c envConfigSource
 	lgr.Verbose("Initializing %s config source", c.Name())
 	lgr.Verbose("Initialized %s config source", c.Name())
@@ -51,15 +53,126 @@ func (c envConfigSource) Get(key string) interface{} {
 	return nil
 }
 
-func (c envConfigSource) Subscribe(key string, callback func(key string, value string)) {
-	return
+func (c envConfigSource) Subscribe(key string, callback func(key string, value string)) Subscription {
+	return SubscriptionFunc(func() {})
+}
+
+func (c envConfigSource) listSize(key string) (int, bool) {
+	indices := make(map[int]bool)
+	for i := 0; ; i++ {
+		if !envKeyExists(fmt.Sprintf("%s[%d]", key, i)) {
+			break
+		}
+		indices[i] = true
+	}
+	return consecutiveSize(indices)
+}
+
+// Keys returns keys of environment variables matching a given prefix. Names are converted to keys
+// by lowercasing and replacing underscores with dots (or indices, for numeric parts), i.e.
+// TENANTS_ACME_QUOTA to tenants.acme.quota and SERVERS_0_HOST to servers[0].host. Variables
+// named by raw keys (i.e. tenants.acme.quota) are returned as they are.
+func (c envConfigSource) Keys(prefix string) []string {
+	names := getPossibleNames(prefix)
+	keys := make([]string, 0)
+	for _, env := range os.Environ() {
+		envName := strings.SplitN(env, "=", 2)[0]
+
+		if strings.Contains(envName, ".") {
+			if prefix == "" || envName == prefix ||
+				strings.HasPrefix(envName, prefix+".") || strings.HasPrefix(envName, prefix+"[") {
+				keys = append(keys, envName)
+			}
+			continue
+		}
+		if prefix == "" {
+			if key := envNameKey("", envName); key != "" {
+				keys = append(keys, key)
+			}
+			continue
+		}
+
+		for _, name := range names {
+			if envName == name {
+				keys = append(keys, prefix)
+				break
+			}
+			if strings.HasPrefix(envName, name+"_") {
+				keys = append(keys, envNameKey(prefix, envName[len(name)+1:]))
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// envNameKey converts a part of environment variable name to a key under a given prefix, i.e.
+// ACME_QUOTA under tenants to tenants.acme.quota and 0_HOST under servers to servers[0].host
+func envNameKey(prefix string, name string) string {
+	key := prefix
+	for _, part := range strings.Split(name, "_") {
+		if part == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(part); err == nil && key != "" {
+			key += "[" + part + "]"
+		} else if key == "" {
+			key = strings.ToLower(part)
+		} else {
+			key += "." + strings.ToLower(part)
+		}
+	}
+	return key
+}
+
+// mapKeys returns keys of a map under a given prefix, found in names of environment variables.
+// For prefix tenants, variable TENANTS_ACME_QUOTA results in key acme, while raw keys (i.e.
+// tenants.acme.quota) are matched as they are.
+func (c envConfigSource) mapKeys(prefix string) []string {
+	if prefix == "" {
+		// every variable would match, environment is not a map
+		return nil
+	}
+
+	names := getPossibleNames(prefix)
+	found := make(map[string]bool)
+	for _, env := range os.Environ() {
+		envName := strings.SplitN(env, "=", 2)[0]
+
+		if strings.HasPrefix(envName, prefix+".") {
+			child := strings.FieldsFunc(envName[len(prefix)+1:], func(r rune) bool {
+				return r == '.' || r == '['
+			})
+			if len(child) > 0 {
+				found[child[0]] = true
+			}
+			continue
+		}
+
+		for _, name := range names {
+			if strings.HasPrefix(envName, name+"_") {
+				child := strings.SplitN(envName[len(name)+1:], "_", 2)[0]
+				// skip list indices
+				if _, err := strconv.Atoi(child); child != "" && err != nil {
+					found[strings.ToLower(child)] = true
+				}
+				break
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(found))
+	for k := range found {
+		keys = append(keys, k)
+	}
+	return keys
 }
 
 func (c envConfigSource) Name() string {
 	return "env"
 }
 
-func (c envConfigSource) ordinal() int {
+func (c envConfigSource) Ordinal() int {
 	return 300
 }
 
@@ -74,11 +187,27 @@ func getPossibleNames(key string) []string {
 		normalizeKeyUpper(key),
 		parseKeyLegacy1(key),
 		parseKeyLegacy2(key),
+		parseKeyIndexed(key),
 	}
 
 	return possibleNames
 }
 
+// envKeyExists checks if a variable exists for a given key, either with a value or as a prefix
+// of nested keys (i.e. SERVERS_0_HOST for key servers[0])
+func envKeyExists(key string) bool {
+	names := getPossibleNames(key)
+	for _, env := range os.Environ() {
+		envName := strings.SplitN(env, "=", 2)[0]
+		for _, name := range names {
+			if envName == name || strings.HasPrefix(envName, name+"_") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // MP Config 1.3: replaces non alpha-numeric characters with '_'
 func normalizeKey(key string) string {
 	re1 := regexp.MustCompile("[^a-zA-Z0-9]")
@@ -101,6 +230,12 @@ func parseKeyLegacy1(key string) string {
 			".", "_", -1))
 }
 
+// indexed: replaces list indices '[0]' with '_0' and other non alpha-numeric characters with '_',
+// to uppercase
+func parseKeyIndexed(key string) string {
+	return normalizeKeyUpper(keyIndexRegexp.ReplaceAllString(key, "_$1"))
+}
+
 // legacy 2: replaces dots with '_', to uppercase
 func parseKeyLegacy2(key string) string {
 	return strings.ToUpper(strings.Replace(key, ".", "_", -1))
@@ -22,6 +22,8 @@
 package config
 
 import (
+	"os"
+	"reflect"
 	"testing"
 )
 
@@ -37,11 +39,186 @@ func TestEnvKey(t *testing.T) {
 	expNorm2 := []string{"KUMULUZEE", "KUMULUZEE_0_", "LEV1_LEV2_5__LEV3", "V_RY_C00L"}
 	expLeg1 := []string{"KUMULUZEE", "KUMULUZEE0", "LEV1_LEV25_LEV3", "V€RYC00L"}
 	expLeg2 := []string{"KUMULUZEE", "KUMULUZEE[0]", "LEV1_LEV2[5]_LEV3", "V€RY-C00L"}
+	expIdx := []string{"KUMULUZEE", "KUMULUZEE_0", "LEV1_LEV2_5_LEV3", "V_RY_C00L"}
 
 	for i, keyName := range keys {
 		envAssert(t, expNorm[i], normalizeKey(keyName))
 		envAssert(t, expNorm2[i], normalizeKeyUpper(keyName))
 		envAssert(t, expLeg1[i], parseKeyLegacy1(keyName))
 		envAssert(t, expLeg2[i], parseKeyLegacy2(keyName))
+		envAssert(t, expIdx[i], parseKeyIndexed(keyName))
+	}
+}
+
+func TestEnvConfigList(t *testing.T) {
+	os.Setenv("SERVERS_0_HOST", "10.1.0.1")
+	os.Setenv("SERVERS_2_HOST", "10.1.0.3")
+	os.Setenv("ENV_LIST_0", "first")
+	os.Setenv("ENV_LIST_1", "second")
+	defer os.Unsetenv("SERVERS_0_HOST")
+	defer os.Unsetenv("SERVERS_2_HOST")
+	defer os.Unsetenv("ENV_LIST_0")
+	defer os.Unsetenv("ENV_LIST_1")
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	if s, ok := c.GetString("servers[0].host"); !(ok && s == "10.1.0.1") {
+		envAssert(t, "10.1.0.1", s)
+	}
+	if s, ok := c.GetString("servers[1].host"); !(ok && s == "10.0.0.2") {
+		// not overridden by env
+		envAssert(t, "10.0.0.2", s)
+	}
+	if n, ok := c.GetListSize("env-list"); !(ok && n == 2) {
+		envAssert(t, 2, n)
+	}
+	if n, ok := c.GetListSize("servers"); !(ok && n == 2) {
+		// SERVERS_2_HOST is not consecutive, list size from file is used
+		envAssert(t, 2, n)
+	}
+}
+
+func TestEnvConfigListSize(t *testing.T) {
+	os.Setenv("SERVERS_0_HOST", "10.1.0.1")
+	os.Setenv("SERVERS_1_HOST", "10.1.0.2")
+	os.Setenv("SERVERS_2_HOST", "10.1.0.3")
+	os.Setenv("ENV_LIST_0", "first")
+	defer os.Unsetenv("SERVERS_0_HOST")
+	defer os.Unsetenv("SERVERS_1_HOST")
+	defer os.Unsetenv("SERVERS_2_HOST")
+	defer os.Unsetenv("ENV_LIST_0")
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources: []ConfigSource{mapConfigSource{"indexed", 50, map[string]interface{}{
+			"env-list[0]": "a",
+			"env-list[1]": "b",
+			"env-list[2]": "c",
+		}}},
+		LogLevel: 100, // turn off logging
+	})
+
+	if n, ok := c.GetListSize("servers"); !(ok && n == 2) {
+		// list in file defines the size, environment variables only override its elements
+		envAssert(t, 2, n)
+	}
+	if n, ok := c.GetListSize("env-list"); !(ok && n == 3) {
+		// without a whole list, the largest list of indexed keys is used
+		envAssert(t, 3, n)
+	}
+}
+
+func TestEnvConfigBundleList(t *testing.T) {
+	os.Setenv("LIST_CONFIG_ORIGINS", "https://a.com, https://b.com")
+	os.Setenv("LIST_CONFIG_PORTS", "80,443")
+	os.Setenv("LIST_CONFIG_RATIOS", "0.5,1.5")
+	os.Setenv("LIST_CONFIG_FLAGS", "true,false")
+	os.Setenv("LIST_CONFIG_INVALID", "1,two")
+	os.Setenv("YAML_ARRAY", "entry5,entry6")
+	defer os.Unsetenv("LIST_CONFIG_ORIGINS")
+	defer os.Unsetenv("LIST_CONFIG_PORTS")
+	defer os.Unsetenv("LIST_CONFIG_RATIOS")
+	defer os.Unsetenv("LIST_CONFIG_FLAGS")
+	defer os.Unsetenv("LIST_CONFIG_INVALID")
+	defer os.Unsetenv("YAML_ARRAY")
+
+	type listConfig struct {
+		Origins   []string
+		Ports     []int
+		Ratios    []float64
+		Flags     []bool
+		Invalid   []int
+		YamlArray []string `config:"yaml-array"`
+	}
+
+	var lc listConfig
+	NewBundle("list-config", &lc, Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	if !reflect.DeepEqual(lc.Origins, []string{"https://a.com", "https://b.com"}) {
+		t.Errorf("expected=%v, got=%v", []string{"https://a.com", "https://b.com"}, lc.Origins)
+	}
+	if !reflect.DeepEqual(lc.Ports, []int{80, 443}) {
+		t.Errorf("expected=%v, got=%v", []int{80, 443}, lc.Ports)
+	}
+	if !reflect.DeepEqual(lc.Ratios, []float64{0.5, 1.5}) {
+		t.Errorf("expected=%v, got=%v", []float64{0.5, 1.5}, lc.Ratios)
+	}
+	if !reflect.DeepEqual(lc.Flags, []bool{true, false}) {
+		t.Errorf("expected=%v, got=%v", []bool{true, false}, lc.Flags)
+	}
+	if lc.Invalid != nil {
+		t.Errorf("expected=%v, got=%v", nil, lc.Invalid)
+	}
+
+	var yc listConfig
+	NewBundle("", &yc, Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+	if !reflect.DeepEqual(yc.YamlArray, []string{"entry5", "entry6"}) {
+		// environment variable overrides list from file
+		t.Errorf("expected=%v, got=%v", []string{"entry5", "entry6"}, yc.YamlArray)
+	}
+}
+
+func TestEnvConfigBundleMap(t *testing.T) {
+	os.Setenv("TENANTS_ACME_QUOTA", "500")
+	os.Setenv("TENANTS_GLOBEX_QUOTA", "50")
+	defer os.Unsetenv("TENANTS_ACME_QUOTA")
+	defer os.Unsetenv("TENANTS_GLOBEX_QUOTA")
+
+	type tenant struct {
+		Quota int
+	}
+	type mapConfig struct {
+		Tenants map[string]tenant
+	}
+
+	var mc mapConfig
+	NewBundle("", &mc, Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	// keys from environment are merged with keys from file
+	expected := map[string]tenant{
+		"acme":   {500},
+		"corp":   {250},
+		"globex": {50},
+	}
+	if !reflect.DeepEqual(mc.Tenants, expected) {
+		t.Errorf("expected=%v, got=%v", expected, mc.Tenants)
+	}
+}
+
+func TestEnvConfigKeys(t *testing.T) {
+	os.Setenv("ROUTES_USERS_URL", "http://users")
+	os.Setenv("ROUTES_ORDERS_0_URL", "http://orders")
+	os.Setenv("routes.billing.url", "http://billing")
+	defer os.Unsetenv("ROUTES_USERS_URL")
+	defer os.Unsetenv("ROUTES_ORDERS_0_URL")
+	defer os.Unsetenv("routes.billing.url")
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	expected := []string{"routes.billing.url", "routes.orders[0].url", "routes.users.url"}
+	if keys := c.Keys("routes"); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected=%v, got=%v", expected, keys)
+	}
+	expected = []string{"billing", "orders", "users"}
+	if keys, ok := c.GetMapKeys("routes"); !(ok && reflect.DeepEqual(keys, expected)) {
+		t.Errorf("expected=%v, got=%v", expected, keys)
+	}
+	if s, ok := c.GetString("routes.orders[0].url"); !(ok && s == "http://orders") {
+		envAssert(t, "http://orders", s)
 	}
 }
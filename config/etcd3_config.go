@@ -0,0 +1,255 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mc0239/logm"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+type etcd3ConfigSource struct {
+	client          etcd3Client
+	startRetryDelay int64
+	maxRetryDelay   int64
+	namespace       string
+	logger          *logm.Logm
+
+	*namespaceCache
+}
+
+// etcd3Client is the part of etcd v3 client used by etcd3ConfigSource
+type etcd3Client interface {
+	Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error)
+	Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan
+	Close() error
+}
+
+func newEtcd3ConfigSource(ctx context.Context, conf Util, namespace string, lgr *logm.Logm) (ConfigSource, error) {
+	etcdConfig := &etcd3ConfigSource{
+		namespaceCache: newNamespaceCache(),
+	}
+	lgr.Verbose("Initializing %s config source", etcdConfig.Name())
+	etcdConfig.logger = lgr
+
+	endpoints := etcdEndpoints(conf)
+
+	client, err := createEtcd3Client(ctx, conf, endpoints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create etcd client: %s", err.Error())
+	}
+	lgr.Info("etcd client address set to %v (API v3)", strings.Join(endpoints, ","))
+	etcdConfig.client = client
+
+	envName, name, version, startRD, maxRD := loadServiceConfiguration(conf)
+	etcdConfig.startRetryDelay = startRD
+	etcdConfig.maxRetryDelay = maxRD
+	lgr.Verbose("start-retry-delay-ms=%d, max-retry-delay-ms=%d", etcdConfig.startRetryDelay, etcdConfig.maxRetryDelay)
+
+	etcdConfig.namespace = extensionNamespace(conf, etcdConfig.Name(), namespace, envName, name, version)
+
+	lgr.Info("etcd key-value namespace: %s", etcdConfig.namespace)
+
+	// load whole namespace at once, watch will keep local copy up to date afterwards
+	revision, err := etcdConfig.load(ctx)
+	if err == nil {
+		lgr.Verbose("Loaded %d keys from %s", len(etcdConfig.values), etcdConfig.Name())
+	} else {
+		lgr.Warning("Error loading keys from namespace %s: %s", etcdConfig.namespace, err.Error())
+	}
+	go etcdConfig.watch(ctx, revision, err == nil)
+
+	lgr.Verbose("Initialized %s config source", etcdConfig.Name())
+	return etcdConfig, nil
+}
+
+func (c *etcd3ConfigSource) Subscribe(key string, callback func(key string, value string)) Subscription {
+	c.logger.Info("Creating a watch for key %s, source: %s", key, c.Name())
+
+	return c.subscribe(key, callback)
+}
+
+func (c *etcd3ConfigSource) Name() string {
+	return "etcd"
+}
+
+func (c *etcd3ConfigSource) Ordinal() int {
+	return 150
+}
+
+// functions that aren't configSource methods
+
+// load reads all keys in namespace with a single prefix get, replaces local copy with them and
+// returns the revision they were read at
+func (c *etcd3ConfigSource) load(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, etcd3RequestTimeout)
+	defer cancel()
+
+	resp, err := c.client.Get(ctx, c.prefix(), clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	values := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		values[strings.TrimPrefix(string(kv.Key), c.prefix())] = string(kv.Value)
+	}
+	c.update(values)
+
+	return resp.Header.Revision, nil
+}
+
+// watch watches the namespace prefix from the revision after the given one and updates the
+// local copy of key-value pairs, notifying subscribers of changed keys. If namespace wasn't
+// loaded yet, it is loaded first, since watching from the first revision would replay its whole
+// history. Watch stops and client is closed when context is done.
+func (c *etcd3ConfigSource) watch(ctx context.Context, revision int64, loaded bool) {
+	defer c.client.Close()
+
+	retry := newBackoff(c.startRetryDelay, c.maxRetryDelay)
+
+	if !loaded {
+		revision, loaded = c.loadWithRetry(ctx, retry)
+	}
+
+	for loaded && ctx.Err() == nil {
+		c.logger.Verbose("Setting a watch on namespace %s from revision %d", c.namespace, revision+1)
+
+		wch := c.client.Watch(ctx, c.prefix(), clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+
+		var err error
+		for resp := range wch {
+			if err = resp.Err(); err != nil {
+				break
+			}
+			retry.reset()
+
+			c.update(c.applyEvents(resp.Events))
+			revision = resp.Header.Revision
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+		if err == nil {
+			err = fmt.Errorf("watch channel closed")
+		}
+		// exponentially extend retry delay, but keep it at most maxRetryDelay
+		retryDelay := retry.next()
+		c.logger.Warning("Watch on %s failed with error: %s, retry delay: %d ms", c.namespace, err.Error(), retryDelay/time.Millisecond)
+
+		// sleep for current delay
+		if !sleepContext(ctx, retryDelay) {
+			break
+		}
+
+		// revision may have been compacted, reload whole namespace before watching again
+		revision, loaded = c.loadWithRetry(ctx, retry)
+	}
+
+	c.logger.Verbose("Watch on namespace %s stopped", c.namespace)
+}
+
+// loadWithRetry loads the namespace, retrying with exponentially increasing delay until it
+// succeeds. It returns the revision keys were read at, or false if context was done before.
+func (c *etcd3ConfigSource) loadWithRetry(ctx context.Context, retry *backoff) (int64, bool) {
+	for {
+		revision, err := c.load(ctx)
+		if err == nil {
+			return revision, true
+		}
+		if ctx.Err() != nil {
+			return 0, false
+		}
+
+		retryDelay := retry.next()
+		c.logger.Warning("Loading namespace %s failed with error: %s, retry delay: %d ms", c.namespace, err.Error(), retryDelay/time.Millisecond)
+
+		if !sleepContext(ctx, retryDelay) {
+			return 0, false
+		}
+	}
+}
+
+// applyEvents returns a copy of local key-value pairs with changes from watch events applied
+func (c *etcd3ConfigSource) applyEvents(events []*clientv3.Event) map[string]string {
+	values := c.snapshot()
+	for _, ev := range events {
+		p := strings.TrimPrefix(string(ev.Kv.Key), c.prefix())
+		if ev.Type == clientv3.EventTypeDelete {
+			delete(values, p)
+		} else {
+			values[p] = string(ev.Kv.Value)
+		}
+	}
+	return values
+}
+
+func (c *etcd3ConfigSource) prefix() string {
+	return path.Join("/", c.namespace) + "/"
+}
+
+// functions that aren't configSource methods or etcd3ConfigSource methods
+
+const etcd3RequestTimeout = 5 * time.Second
+
+// etcdAPIVersion returns the etcd API version set with kumuluzee.config.etcd.api-version,
+// defaulting to 2. Versions other than 2 and 3 are reported as an error.
+func etcdAPIVersion(conf Util) (int, error) {
+	v := conf.Get("kumuluzee.config.etcd.api-version")
+	if v == nil {
+		return 2, nil
+	}
+	version := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(valueString(v))), "v")
+	switch version {
+	case "2":
+		return 2, nil
+	case "3":
+		return 3, nil
+	default:
+		return 0, fmt.Errorf("unsupported etcd API version %v in kumuluzee.config.etcd.api-version, supported versions are: 2, 3", v)
+	}
+}
+
+// createEtcd3Client creates an etcd v3 client for given endpoints. Credentials and TLS settings
+// are read from kumuluzee.config.etcd namespace in configuration.
+func createEtcd3Client(ctx context.Context, conf Util, endpoints []string) (*clientv3.Client, error) {
+	clientConfig := clientv3.Config{}
+	clientConfig.Context = ctx
+	clientConfig.Endpoints = endpoints
+	clientConfig.DialTimeout = etcd3RequestTimeout
+	clientConfig.Username, clientConfig.Password = etcdCredentials(conf)
+
+	tlsConfig, err := etcdTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig.TLS = tlsConfig
+
+	return clientv3.New(clientConfig)
+}
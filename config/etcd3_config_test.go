@@ -0,0 +1,319 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mc0239/logm"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+// etcd3Stub is an in-process etcd v3 client. Prefix gets return a copy of values at current
+// revision, watch responses are sent by the test through channels from watches.
+type etcd3Stub struct {
+	mu        sync.Mutex
+	values    map[string]string
+	revision  int64
+	failGets  int
+	gets      int
+	watchRevs []int64
+	closed    bool
+
+	watches chan chan<- clientv3.WatchResponse
+}
+
+func newEtcd3Stub(values map[string]string, revision int64) *etcd3Stub {
+	return &etcd3Stub{
+		values:   values,
+		revision: revision,
+		watches:  make(chan chan<- clientv3.WatchResponse, 10),
+	}
+}
+
+func (s *etcd3Stub) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gets++
+	if s.failGets > 0 {
+		s.failGets--
+		return nil, errors.New("etcd unavailable")
+	}
+	resp := &clientv3.GetResponse{Header: &etcdserverpb.ResponseHeader{Revision: s.revision}}
+	for k, v := range s.values {
+		resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(key + k), Value: []byte(v)})
+	}
+	return resp, nil
+}
+
+func (s *etcd3Stub) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	s.mu.Lock()
+	s.watchRevs = append(s.watchRevs, clientv3.OpGet(key, opts...).Rev())
+	s.mu.Unlock()
+
+	// like etcd client, watch channel is closed when context is done
+	in := make(chan clientv3.WatchResponse)
+	out := make(chan clientv3.WatchResponse)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case resp := <-in:
+				select {
+				case out <- resp:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	s.watches <- in
+	return out
+}
+
+func (s *etcd3Stub) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *etcd3Stub) set(values map[string]string, revision int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values, s.revision = values, revision
+}
+
+func TestEtcdAPIVersion(t *testing.T) {
+	versions := []interface{}{nil, 2, 3, "3", "v3", "V3", "v2"}
+	expected := []int{2, 2, 3, 3, 3, 3, 2}
+
+	for i, version := range versions {
+		values := map[string]interface{}{}
+		if version != nil {
+			values["kumuluzee.config.etcd.api-version"] = version
+		}
+		c := NewUtil(Options{
+			ConfigPath: "../test/config.yaml",
+			Sources:    []ConfigSource{mapConfigSource{"versions", 400, values}},
+			LogLevel:   100, // turn off logging
+		})
+		if v, err := etcdAPIVersion(c); err != nil || v != expected[i] {
+			t.Errorf("api-version=%v: expected=%v, got=%v (%v)", version, expected[i], v, err)
+		}
+	}
+}
+
+func TestEtcdAPIVersionUnsupported(t *testing.T) {
+	for _, version := range []interface{}{4, "v33", "three", 2.5} {
+		c := NewUtil(Options{
+			ConfigPath: "../test/config.yaml",
+			Sources: []ConfigSource{mapConfigSource{"versions", 400, map[string]interface{}{
+				"kumuluzee.config.etcd.api-version": version,
+			}}},
+			LogLevel: 100, // turn off logging
+		})
+		if _, err := etcdAPIVersion(c); err == nil {
+			t.Errorf("api-version=%v: expected an error", version)
+		}
+
+		// unsupported version is reported as an etcd source error instead of using v2 client
+		_, err := NewUtilE(Options{
+			ConfigPath: "../test/config.yaml",
+			Extension:  "etcd",
+			Sources: []ConfigSource{mapConfigSource{"versions", 400, map[string]interface{}{
+				"kumuluzee.config.etcd.api-version": version,
+			}}},
+			LogLevel: 100, // turn off logging
+		})
+		if serr, ok := err.(*SourceError); !ok || serr.Source != "etcd" {
+			t.Errorf("api-version=%v: expected etcd *SourceError, got=%v", version, err)
+		}
+	}
+}
+
+func TestEtcd3ConfigApplyEvents(t *testing.T) {
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+
+	c := &etcd3ConfigSource{
+		namespace:      "environments/dev/services/test/1.0.0/config",
+		logger:         &lgr,
+		namespaceCache: newNamespaceCache(),
+	}
+	c.values = map[string]string{"string-value": "a", "servers/[0]/host": "10.0.0.1"}
+
+	var mu sync.Mutex
+	notified := make(map[string]string)
+	for _, key := range []string{"string-value", "servers", "tenants.acme", "unchanged"} {
+		c.Subscribe(key, func(key string, value string) {
+			mu.Lock()
+			defer mu.Unlock()
+			notified[key] = value
+		})
+	}
+
+	event := func(t mvccpb.Event_EventType, key string, value string) *clientv3.Event {
+		return &clientv3.Event{
+			Type: t,
+			Kv:   &mvccpb.KeyValue{Key: []byte(c.prefix() + key), Value: []byte(value)},
+		}
+	}
+	c.update(c.applyEvents([]*clientv3.Event{
+		event(clientv3.EventTypeDelete, "string-value", ""),
+		event(clientv3.EventTypePut, "servers/[1]/host", "10.0.0.2"),
+		event(clientv3.EventTypePut, "tenants/acme/quota", "100"),
+		event(clientv3.EventTypePut, "tenants/acme/quota", "200"),
+	}))
+
+	if v := c.Get("string-value"); v != nil {
+		t.Errorf("expected=%v, got=%v", nil, v)
+	}
+	if v := c.Get("servers[1].host"); v != "10.0.0.2" {
+		t.Errorf("expected=%v, got=%v", "10.0.0.2", v)
+	}
+	if v := c.Get("tenants.acme.quota"); v != "200" {
+		t.Errorf("expected=%v, got=%v", "200", v)
+	}
+	if size, ok := c.listSize("servers"); !(ok && size == 2) {
+		t.Errorf("expected=%v, got=%v", 2, size)
+	}
+	keys := c.Keys("")
+	sort.Strings(keys)
+	if expected := []string{"servers[0].host", "servers[1].host", "tenants.acme.quota"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected=%v, got=%v", expected, keys)
+	}
+	if keys := c.mapKeys("tenants"); !reflect.DeepEqual(keys, []string{"acme"}) {
+		t.Errorf("expected=%v, got=%v", []string{"acme"}, keys)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := map[string]string{"string-value": "", "servers": "", "tenants.acme": ""}
+	if !reflect.DeepEqual(notified, expected) {
+		t.Errorf("expected=%v, got=%v", expected, notified)
+	}
+}
+
+func TestEtcd3ConfigWatch(t *testing.T) {
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+
+	// first load fails, so watch has to load namespace before watching
+	stub := newEtcd3Stub(map[string]string{"a": "1"}, 10)
+	stub.failGets = 1
+
+	c := &etcd3ConfigSource{
+		client:          stub,
+		startRetryDelay: 1,
+		maxRetryDelay:   5,
+		namespace:       "test",
+		logger:          &lgr,
+		namespaceCache:  newNamespaceCache(),
+	}
+
+	updates := make(chan string, 10)
+	for _, key := range []string{"a", "b"} {
+		c.Subscribe(key, func(key string, value string) {
+			updates <- key + "=" + value
+		})
+	}
+	expectUpdate := func(expected string) {
+		select {
+		case u := <-updates:
+			if u != expected {
+				t.Errorf("expected=%v, got=%v", expected, u)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch was not fired, expected %s", expected)
+		}
+	}
+	nextWatch := func() chan<- clientv3.WatchResponse {
+		select {
+		case w := <-stub.watches:
+			return w
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch was not set")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.watch(ctx, 0, false)
+		close(done)
+	}()
+
+	w := nextWatch()
+	expectUpdate("a=1")
+	if v := c.Get("a"); v != "1" {
+		t.Errorf("expected=%v, got=%v", "1", v)
+	}
+
+	// watch event is applied to local copy
+	resp := clientv3.WatchResponse{Events: []*clientv3.Event{{
+		Type: clientv3.EventTypePut,
+		Kv:   &mvccpb.KeyValue{Key: []byte(c.prefix() + "b"), Value: []byte("2")},
+	}}}
+	resp.Header.Revision = 11
+	w <- resp
+	expectUpdate("b=2")
+
+	// after compaction, namespace is reloaded and changes missed in the meantime are applied
+	stub.set(map[string]string{"a": "3", "b": "2"}, 20)
+	w <- clientv3.WatchResponse{CompactRevision: 15}
+	nextWatch()
+	expectUpdate("a=3")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch did not stop")
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.gets != 3 {
+		t.Errorf("expected=%v gets, got=%v", 3, stub.gets)
+	}
+	// watches start after revisions namespace was loaded at
+	if expected := []int64{11, 21}; !reflect.DeepEqual(stub.watchRevs, expected) {
+		t.Errorf("expected=%v, got=%v", expected, stub.watchRevs)
+	}
+	if !stub.closed {
+		t.Errorf("client was not closed")
+	}
+}
@@ -23,7 +23,12 @@ package config
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"path"
 	"strings"
 	"time"
@@ -34,6 +39,7 @@ import (
 )
 
 type etcdConfigSource struct {
+	ctx             context.Context
 	client          *client.Client
 	startRetryDelay int64
 	maxRetryDelay   int64
@@ -41,115 +47,200 @@ type etcdConfigSource struct {
 	logger          *logm.Logm
 }
 
-func newEtcdConfigSource(conf Util, namespace string, lgr *logm.Logm) configSource {
+func newEtcdConfigSource(ctx context.Context, conf Util, namespace string, lgr *logm.Logm) (ConfigSource, error) {
 	var etcdConfig etcdConfigSource
 	lgr.Verbose("Initializing %s config source", etcdConfig.Name())
+	etcdConfig.ctx = ctx
 	etcdConfig.logger = lgr
 
-	var etcdAddress string
-	if addr, ok := conf.GetString("kumuluzee.config.etcd.hosts"); ok {
-		etcdAddress = addr
-	} else {
-		etcdAddress = "http://localhost:2379"
-	}
+	endpoints := etcdEndpoints(conf)
 
-	if client, err := createEtcdClient(etcdAddress); err == nil {
-		lgr.Info("etcd client address set to %v", etcdAddress)
-		etcdConfig.client = client
-	} else {
-		lgr.Error("Failed to create etcd client: %s", err.Error())
+	client, err := createEtcdClient(conf, endpoints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create etcd client: %s", err.Error())
 	}
+	lgr.Info("etcd client address set to %v", strings.Join(endpoints, ","))
+	etcdConfig.client = client
 
 	envName, name, version, startRD, maxRD := loadServiceConfiguration(conf)
 	etcdConfig.startRetryDelay = startRD
 	etcdConfig.maxRetryDelay = maxRD
 	lgr.Verbose("start-retry-delay-ms=%d, max-retry-delay-ms=%d", etcdConfig.startRetryDelay, etcdConfig.maxRetryDelay)
 
-	etcdConfig.namespace = fmt.Sprintf("environments/%s/services/%s/%s/config", envName, name, version)
-	// namespace can be overwritten from configuration file ...
-	if ns, ok := conf.GetString("kumuluzee.config.namespace"); ok {
-		if ns != "" {
-			etcdConfig.namespace = ns
-		}
-	}
-	// ... or programmatically by passing it into config.Options
-	if namespace != "" {
-		etcdConfig.namespace = namespace
-	}
+	etcdConfig.namespace = extensionNamespace(conf, etcdConfig.Name(), namespace, envName, name, version)
 
 	lgr.Info("etcd key-value namespace: %s", etcdConfig.namespace)
 	lgr.Verbose("Initialized %s config source", etcdConfig.Name())
-	return etcdConfig
+	return etcdConfig, nil
 }
 
 func (c etcdConfigSource) Get(key string) interface{} {
 	kv := client.NewKeysAPI(*c.client)
 
-	key = strings.Replace(key, ".", "/", -1)
-	//fmt.Printf("KV path: %s\n", path.Join(c.namespace, key))
+	//fmt.Printf("KV path: %s\n", path.Join(c.namespace, keyPath(key)))
 
-	resp, err := kv.Get(context.Background(), path.Join(c.namespace, key), nil)
+	resp, err := kv.Get(c.ctx, path.Join(c.namespace, keyPath(key)), nil)
 	if err != nil {
-		c.logger.Warning("Error getting value: %v", err)
+		// missing keys are expected, since every key is looked up in all configuration sources
+		if !client.IsKeyNotFound(err) {
+			c.logger.Warning("Error getting value: %v", err)
+		}
 		return nil
 	}
 
+	// directories hold lists and maps (i.e. servers/[0]/host), which have no value of their own
+	if resp.Node.Dir {
+		return nil
+	}
 	return resp.Node.Value
 }
 
-func (c etcdConfigSource) Subscribe(key string, callback func(key string, value string)) {
+func (c etcdConfigSource) Subscribe(key string, callback func(key string, value string)) Subscription {
 	c.logger.Info("Creating a watch for key %s, source: %s", key, c.Name())
-	go c.watch(key, "", c.startRetryDelay, callback)
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	go c.watch(ctx, key, callback)
+
+	return SubscriptionFunc(cancel)
+}
+
+func (c etcdConfigSource) listSize(key string) (int, bool) {
+	kv := client.NewKeysAPI(*c.client)
+
+	resp, err := kv.Get(c.ctx, path.Join(c.namespace, keyPath(key)), nil)
+	if err != nil || !resp.Node.Dir {
+		return 0, false
+	}
+
+	// list elements are stored in directories (or keys) named [0], [1], ...
+	indices := make(map[int]bool)
+	for _, node := range resp.Node.Nodes {
+		name := path.Base(node.Key)
+		if _, idx := splitKeyIndices(name); len(idx) == 1 && name == fmt.Sprintf("[%d]", idx[0]) {
+			indices[idx[0]] = true
+		}
+	}
+	return consecutiveSize(indices)
+}
+
+func (c etcdConfigSource) Keys(prefix string) []string {
+	kv := client.NewKeysAPI(*c.client)
+
+	root := path.Join("/", c.namespace)
+	resp, err := kv.Get(c.ctx, path.Join(root, keyPath(prefix)), &client.GetOptions{Recursive: true})
+	if err != nil {
+		return nil
+	}
+
+	var keys []string
+	var walk func(node *client.Node)
+	walk = func(node *client.Node) {
+		if !node.Dir {
+			keys = append(keys, pathKey(strings.TrimPrefix(node.Key, root+"/")))
+			return
+		}
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+	}
+	walk(resp.Node)
+	return keys
+}
+
+func (c etcdConfigSource) mapKeys(prefix string) []string {
+	kv := client.NewKeysAPI(*c.client)
+
+	resp, err := kv.Get(c.ctx, path.Join(c.namespace, keyPath(prefix)), nil)
+	if err != nil || !resp.Node.Dir {
+		return nil
+	}
+
+	keys := make([]string, 0, len(resp.Node.Nodes))
+	for _, node := range resp.Node.Nodes {
+		if name := path.Base(node.Key); !strings.HasPrefix(name, "[") {
+			keys = append(keys, name)
+		}
+	}
+	return keys
 }
 
 func (c etcdConfigSource) Name() string {
 	return "etcd"
 }
 
-func (c etcdConfigSource) ordinal() int {
+func (c etcdConfigSource) Ordinal() int {
 	return 150
 }
 
 // functions that aren't configSource methods
 
-func (c etcdConfigSource) watch(key string, previousValue string, retryDelay int64, callback func(key string, value string)) {
-
+// watch waits for changes of a given key or keys under it and fires callback on every change.
+// Watch stops when context is done.
+func (c etcdConfigSource) watch(ctx context.Context, key string, callback func(key string, value string)) {
 	c.logger.Verbose("Set a watch on key %s", key)
 
-	key = strings.Replace(key, ".", "/", -1)
+	nodePath := path.Join(c.namespace, keyPath(key))
 	kv := client.NewKeysAPI(*c.client)
 
-	watcher := kv.Watcher(path.Join(c.namespace, key), nil)
+	retry := newBackoff(c.startRetryDelay, c.maxRetryDelay)
+	watcher := kv.Watcher(nodePath, &client.WatcherOptions{Recursive: true})
 
-	resp, err := watcher.Next(context.Background())
-	if err != nil {
-		c.logger.Warning("Watch on %s failed with error: %s, retry delay: %d ms", key, err.Error(), retryDelay)
+	for ctx.Err() == nil {
+		resp, err := watcher.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+
+			// exponentially extend retry delay, but keep it at most maxRetryDelay
+			retryDelay := retry.next()
+			c.logger.Warning("Watch on %s failed with error: %s, retry delay: %d ms", key, err.Error(), retryDelay/time.Millisecond)
 
-		// sleep for current delay
-		time.Sleep(time.Duration(retryDelay) * time.Millisecond)
+			// sleep for current delay
+			if !sleepContext(ctx, retryDelay) {
+				break
+			}
 
-		// exponentially extend retry delay, but keep it at most maxRetryDelay
-		newRetryDelay := retryDelay * 2
-		if newRetryDelay > c.maxRetryDelay {
-			newRetryDelay = c.maxRetryDelay
+			// watch index may have been cleared, start watching from current index again
+			watcher = kv.Watcher(nodePath, &client.WatcherOptions{Recursive: true})
+			continue
 		}
-		c.watch(key, "", newRetryDelay, callback)
-		return
-	}
+		retry.reset()
 
-	c.logger.Verbose("Wait time on watch for key %s reached.", key)
+		c.logger.Verbose("Watch on key %s received %s of %s", key, resp.Action, resp.Node.Key)
 
-	if string(resp.Node.Value) != previousValue {
-		callback(key, string(resp.Node.Value))
+		// with a recursive watch, node is the changed key itself or any key under it, so callback
+		// is fired on every event; unchanged effective values are filtered out by Util's watches
+		callback(key, resp.Node.Value)
 	}
-	c.watch(key, string(resp.Node.Value), c.startRetryDelay, callback)
+
+	c.logger.Verbose("Watch on key %s stopped", key)
 }
 
 // functions that aren't configSource methods or etcdCondigSource methods
 
-func createEtcdClient(address string) (*client.Client, error) {
+// createEtcdClient creates an etcd v2 client for given endpoints. Credentials and TLS settings
+// are read from kumuluzee.config.etcd namespace in configuration.
+func createEtcdClient(conf Util, endpoints []string) (*client.Client, error) {
 	clientConfig := client.Config{}
-	clientConfig.Endpoints = []string{address}
+	clientConfig.Endpoints = endpoints
+	clientConfig.Username, clientConfig.Password = etcdCredentials(conf)
+
+	tlsConfig, err := etcdTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		clientConfig.Transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsConfig,
+		}
+	}
 
 	cl, err := client.New(clientConfig)
 	if err != nil {
@@ -157,3 +248,65 @@ func createEtcdClient(address string) (*client.Client, error) {
 	}
 	return &cl, nil
 }
+
+// etcdEndpoints returns etcd endpoints from comma-separated kumuluzee.config.etcd.hosts
+func etcdEndpoints(conf Util) []string {
+	endpoints := stringList(conf, "kumuluzee.config.etcd.hosts")
+	if len(endpoints) == 0 {
+		return []string{"http://localhost:2379"}
+	}
+	return endpoints
+}
+
+// etcdCredentials returns username and password for etcd authentication
+func etcdCredentials(conf Util) (username string, password string) {
+	username, _ = conf.GetString("kumuluzee.config.etcd.username")
+	password, _ = conf.GetString("kumuluzee.config.etcd.password")
+	return
+}
+
+// etcdTLSConfig returns TLS configuration for etcd clients or nil, if TLS is not configured.
+// Like in KumuluzEE Java, CA certificate can be set as PEM encoded string with
+// kumuluzee.config.etcd.ca, or it can be read from a file.
+func etcdTLSConfig(conf Util) (*tls.Config, error) {
+	ca, hasCA := conf.GetString("kumuluzee.config.etcd.ca")
+	caFile, hasCAFile := conf.GetString("kumuluzee.config.etcd.tls.ca-file")
+	certFile, hasCertFile := conf.GetString("kumuluzee.config.etcd.tls.cert-file")
+	keyFile, hasKeyFile := conf.GetString("kumuluzee.config.etcd.tls.key-file")
+	skip, hasSkip := conf.GetBool("kumuluzee.config.etcd.tls.insecure-skip-verify")
+	if !hasCA && !hasCAFile && !hasCertFile && !hasKeyFile && !hasSkip {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: skip}
+
+	if hasCA || hasCAFile {
+		pool := x509.NewCertPool()
+		if hasCA && !pool.AppendCertsFromPEM([]byte(ca)) {
+			return nil, fmt.Errorf("no valid certificates in kumuluzee.config.etcd.ca")
+		}
+		if hasCAFile {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file: %s", err.Error())
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no valid certificates in CA file %s", caFile)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if hasCertFile != hasKeyFile {
+		return nil, fmt.Errorf("both client certificate and key files must be set")
+	}
+	if hasCertFile {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
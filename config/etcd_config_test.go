@@ -0,0 +1,448 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// etcdStub is a minimal etcd v2 keys API, answering every watch immediately with a new index.
+// Value of the key changes on every second watch response.
+type etcdStub struct {
+	mu       sync.Mutex
+	requests int
+	watches  int
+	fail     bool
+	server   *httptest.Server
+
+	// credentials of the last request
+	username string
+	password string
+}
+
+func newEtcdStub() *etcdStub {
+	s := &etcdStub{}
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+func newEtcdTLSStub() *etcdStub {
+	s := &etcdStub{}
+	s.server = httptest.NewTLSServer(s)
+	return s
+}
+
+func (s *etcdStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	if r.URL.Query().Get("wait") == "true" {
+		s.watches++
+	}
+	s.username, s.password, _ = r.BasicAuth()
+	index, fail := s.requests, s.fail
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", fmt.Sprint(index))
+	if fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"errorCode": 300,
+			"message":   "Raft Internal Error",
+			"index":     index,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"action": "set",
+		"node": map[string]interface{}{
+			"key":           r.URL.Path,
+			"value":         fmt.Sprintf("value-%d", index/2),
+			"modifiedIndex": index,
+		},
+	})
+}
+
+func (s *etcdStub) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *etcdStub) credentials() (username string, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.username, s.password
+}
+
+func (s *etcdStub) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *etcdStub) watchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.watches
+}
+
+func TestEtcdConfigWatchIterations(t *testing.T) {
+	stub := newEtcdStub()
+	defer stub.server.Close()
+
+	c := NewUtil(Options{
+		Extension:          "etcd",
+		ExtensionNamespace: "test",
+		Sources: []ConfigSource{mapConfigSource{"stub", 50, map[string]interface{}{
+			"kumuluzee.config.etcd.hosts":           stub.server.URL,
+			"kumuluzee.config.start-retry-delay-ms": 1,
+			"kumuluzee.config.max-retry-delay-ms":   2,
+		}}},
+		LogLevel: 100, // turn off logging
+	})
+	defer c.Close()
+
+	var mu sync.Mutex
+	var updates int
+	c.Subscribe("string-value", func(key string, value string) {
+		mu.Lock()
+		defer mu.Unlock()
+		updates++
+	})
+
+	// thousands of watch responses, value changes on every second one
+	if !waitFor(30*time.Second, func() bool { return stub.watchCount() > 3000 }) {
+		t.Fatalf("watch did not reach 3000 iterations")
+	}
+	if _, f := stackFrames("config.etcdConfigSource.watch"); f != 1 {
+		t.Errorf("expected a single watch frame, got=%d", f)
+	}
+	mu.Lock()
+	if updates < 1000 {
+		t.Errorf("expected at least 1000 updates, got=%d", updates)
+	}
+	mu.Unlock()
+
+	// thousands of failed watches
+	stub.setFail(true)
+	requests := stub.requestCount()
+	if !waitFor(30*time.Second, func() bool { return stub.requestCount() > requests+1000 }) {
+		t.Fatalf("watch did not retry 1000 times")
+	}
+	if _, f := stackFrames("config.etcdConfigSource.watch"); f != 1 {
+		t.Errorf("expected a single watch frame, got=%d", f)
+	}
+
+	watches, _ := stackFrames("config.etcdConfigSource.watch")
+	c.Close()
+	if !waitFor(5*time.Second, func() bool {
+		g, _ := stackFrames("config.etcdConfigSource.watch")
+		return g == watches-1
+	}) {
+		t.Errorf("watch goroutine did not stop")
+	}
+}
+
+func TestEtcdConfigEndpointsAndTLS(t *testing.T) {
+	stub := newEtcdTLSStub()
+	defer stub.server.Close()
+
+	// first endpoint is not available
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	unavailable.Close()
+
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, _ := writeServerCertificate(t, stub.server, dir)
+	ca, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewUtilE(Options{
+		ConfigPath:         "../test/config.yaml",
+		Extension:          "etcd",
+		ExtensionNamespace: "test",
+		Sources: []ConfigSource{mapConfigSource{"stub", 50, map[string]interface{}{
+			"kumuluzee.config.etcd.hosts":    unavailable.URL + ", " + stub.server.URL,
+			"kumuluzee.config.etcd.username": "user",
+			"kumuluzee.config.etcd.password": "pass",
+			"kumuluzee.config.etcd.ca":       string(ca),
+		}}},
+		LogLevel: 100, // turn off logging
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if s, ok := c.GetString("etcd-value"); !(ok && strings.HasPrefix(s, "value-")) {
+		t.Errorf("expected=%v, got=%v", "value-*", s)
+	}
+	if username, password := stub.credentials(); username != "user" || password != "pass" {
+		t.Errorf("expected=%v, got=%v", "user:pass", username+":"+password)
+	}
+}
+
+func TestEtcdTLSConfig(t *testing.T) {
+	stub := newEtcdTLSStub()
+	defer stub.server.Close()
+
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeServerCertificate(t, stub.server, dir)
+
+	tlsConfig := func(values map[string]interface{}) (*tls.Config, error) {
+		return etcdTLSConfig(NewUtil(Options{
+			ConfigPath: "../test/config.yaml",
+			Sources:    []ConfigSource{mapConfigSource{"stub", 50, values}},
+			LogLevel:   100, // turn off logging
+		}))
+	}
+
+	if c, err := tlsConfig(map[string]interface{}{}); c != nil || err != nil {
+		t.Errorf("expected no TLS configuration, got=%v, err=%v", c, err)
+	}
+
+	c, err := tlsConfig(map[string]interface{}{
+		"kumuluzee.config.etcd.tls.ca-file":   certFile,
+		"kumuluzee.config.etcd.tls.cert-file": certFile,
+		"kumuluzee.config.etcd.tls.key-file":  keyFile,
+	})
+	if err != nil || c.RootCAs == nil || len(c.Certificates) != 1 {
+		t.Errorf("expected CA and client certificate, got=%v, err=%v", c, err)
+	}
+
+	invalid := []map[string]interface{}{
+		{"kumuluzee.config.etcd.ca": "not a certificate"},
+		{"kumuluzee.config.etcd.tls.ca-file": filepath.Join(dir, "missing.pem")},
+		{"kumuluzee.config.etcd.tls.ca-file": keyFile},
+		{"kumuluzee.config.etcd.tls.cert-file": certFile},
+		{"kumuluzee.config.etcd.tls.cert-file": keyFile, "kumuluzee.config.etcd.tls.key-file": certFile},
+	}
+	for _, values := range invalid {
+		if _, err := tlsConfig(values); err == nil {
+			t.Errorf("expected an error for %v", values)
+		}
+	}
+}
+
+// etcdTreeStub is a minimal etcd v2 keys API serving a fixed set of keys, with directories for
+// keys under them. Watches never fire.
+type etcdTreeStub struct {
+	values map[string]string
+	server *httptest.Server
+}
+
+func newEtcdTreeStub(values map[string]string) *etcdTreeStub {
+	s := &etcdTreeStub{values: values}
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+func (s *etcdTreeStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("wait") == "true" {
+		<-r.Context().Done()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", "1")
+
+	key := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/keys"), "/")
+	node, ok := s.node(key, r.URL.Query().Get("recursive") == "true", true)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"errorCode": 100,
+			"message":   "Key not found",
+			"cause":     key,
+			"index":     1,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"action": "get",
+		"node":   node,
+	})
+}
+
+// node returns a key or a directory with its children, which are listed recursively or one
+// level deep
+func (s *etcdTreeStub) node(key string, recursive bool, children bool) (map[string]interface{}, bool) {
+	if value, ok := s.values[key]; ok {
+		return map[string]interface{}{"key": key, "value": value}, true
+	}
+
+	names := make(map[string]bool)
+	for k := range s.values {
+		if strings.HasPrefix(k, key+"/") {
+			names[strings.SplitN(k[len(key)+1:], "/", 2)[0]] = true
+		}
+	}
+	if len(names) == 0 {
+		return nil, false
+	}
+
+	dir := map[string]interface{}{"key": key, "dir": true}
+	if children {
+		var nodes []interface{}
+		for _, name := range sortedKeys(names) {
+			child, _ := s.node(key+"/"+name, recursive, recursive)
+			nodes = append(nodes, child)
+		}
+		dir["nodes"] = nodes
+	}
+	return dir, true
+}
+
+func TestEtcdConfigDirectories(t *testing.T) {
+	stub := newEtcdTreeStub(map[string]string{
+		"/test/servers/[0]/host":    "etcd-host",
+		"/test/tenants/acme/quota":  "500",
+		"/test/some-config/version": "2.0.0",
+	})
+	defer stub.server.Close()
+
+	c, err := NewUtilE(Options{
+		ConfigPath:         "../test/config.yaml",
+		Extension:          "etcd",
+		ExtensionNamespace: "test",
+		Sources: []ConfigSource{mapConfigSource{"stub", 50, map[string]interface{}{
+			"kumuluzee.config.etcd.hosts": stub.server.URL,
+		}}},
+		LogLevel: 100, // turn off logging
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// directories don't hide lists and maps from configuration file
+	if l, ok := c.Get("servers").([]interface{}); !ok || len(l) != 2 {
+		t.Errorf("expected list from configuration file, got=%#v", c.Get("servers"))
+	}
+	if s, ok := c.GetString("servers[0].host"); !(ok && s == "etcd-host") {
+		t.Errorf("expected=%v, got=%v", "etcd-host", s)
+	}
+	if i, ok := c.GetInt("tenants.acme.quota"); !(ok && i == 500) {
+		t.Errorf("expected=%v, got=%v", 500, i)
+	}
+	m, ok := c.Get("some-config").(map[string]interface{})
+	if !ok || m["protocol"] != "tcp" {
+		t.Errorf("expected map from configuration file, got=%#v", c.Get("some-config"))
+	}
+	if v := c.Get("missing-value"); v != nil {
+		t.Errorf("expected=%v, got=%v", nil, v)
+	}
+
+}
+
+func TestEtcdConfigBundleList(t *testing.T) {
+	stub := newEtcdTreeStub(map[string]string{
+		"/test/tags/[0]":  "a",
+		"/test/tags/[1]":  "b",
+		"/test/ports/[0]": "80",
+		"/test/ports/[1]": "443",
+	})
+	defer stub.server.Close()
+
+	var bundle struct {
+		Tags  []string `config:"tags"`
+		Ports []int    `config:"ports"`
+	}
+	_, err := NewBundleE("", &bundle, Options{
+		ConfigPath:         "../test/config.yaml",
+		Extension:          "etcd",
+		ExtensionNamespace: "test",
+		Sources: []ConfigSource{mapConfigSource{"stub", 50, map[string]interface{}{
+			"kumuluzee.config.etcd.hosts": stub.server.URL,
+		}}},
+		LogLevel: 100, // turn off logging
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(bundle.Tags, ",") != "a,b" {
+		t.Errorf("expected=%v, got=%v", "[a b]", bundle.Tags)
+	}
+	if len(bundle.Ports) != 2 || bundle.Ports[0] != 80 || bundle.Ports[1] != 443 {
+		t.Errorf("expected=%v, got=%v", "[80 443]", bundle.Ports)
+	}
+}
+
+func TestEtcdConfigWatchRepeatedValues(t *testing.T) {
+	stub := newEtcdStub()
+	defer stub.server.Close()
+
+	c := NewUtil(Options{
+		ConfigPath:         "../test/config.yaml",
+		Extension:          "etcd",
+		ExtensionNamespace: "test",
+		Sources: []ConfigSource{mapConfigSource{"stub", 50, map[string]interface{}{
+			"kumuluzee.config.etcd.hosts": stub.server.URL,
+		}}},
+		LogLevel: 100, // turn off logging
+	})
+	defer c.Close()
+
+	// every watch event is reported by the source, even if it has the same value as the previous
+	// one (i.e. a change of another key in a watched directory)
+	var mu sync.Mutex
+	var previous string
+	var repeated int
+	c.sourceByName(t, "etcd").Subscribe("servers", func(key string, value string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if value == previous {
+			repeated++
+		}
+		previous = value
+	})
+
+	if !waitFor(10*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return repeated > 10
+	}) {
+		t.Errorf("expected repeated values to be reported")
+	}
+}
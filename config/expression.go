@@ -0,0 +1,242 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Property expressions reference values of other keys, i.e. ${db.host}, optionally with a
+// default value used when referenced key is not found, i.e. ${db.port:5432}. Referenced keys are
+// retrieved through all configuration sources, ordered by their ordinals. Expressions can be
+// escaped with a backslash, i.e. \${literal}.
+
+// resolve resolves property expressions in a value retrieved for a given key. Values that aren't
+// strings or don't contain expressions are returned as they are. If a value is a single
+// expression, referenced value is returned with its own type (i.e. int for ${db.port}).
+// Values that can't be resolved (i.e. circular references) are logged and returned as they are.
+func (c Util) resolve(key string, value interface{}) interface{} {
+	resolved, err := c.resolveValue(key, value)
+	if err != nil {
+		return value
+	}
+	return resolved
+}
+
+// resolveValue resolves property expressions like resolve, but returns an error if value can't
+// be resolved, so that typed getters can report it as not found
+func (c Util) resolveValue(key string, value interface{}) (interface{}, error) {
+	s, ok := value.(string)
+	if !ok || !strings.Contains(s, "${") {
+		return value, nil
+	}
+
+	resolved, err := c.resolveString(s, []string{key}, nil)
+	if err != nil {
+		if c.logger != nil {
+			c.logger.Error("Could not resolve value of key %s: %s", key, err.Error())
+		}
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// references returns keys referenced by property expressions in the value of a given key,
+// including keys referenced by values of referenced keys
+func (c Util) references(key string) map[string]bool {
+	refs := make(map[string]bool)
+	if s, ok := c.getRaw(key).(string); ok {
+		c.resolveString(s, []string{key}, refs)
+	}
+	return refs
+}
+
+// resolveString resolves all expressions in s. Stack holds keys, which values are being
+// resolved, and is used to detect circular references. If refs is not nil, referenced keys are
+// added to it.
+func (c Util) resolveString(s string, stack []string, refs map[string]bool) (interface{}, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if strings.HasPrefix(s[i:], `\${`) {
+			b.WriteString("${")
+			i += 3
+			continue
+		}
+		if !strings.HasPrefix(s[i:], "${") {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+
+		end := expressionEnd(s, i+2)
+		if end < 0 {
+			// unterminated expression is not an expression
+			b.WriteString(s[i:])
+			break
+		}
+
+		value, err := c.resolveExpression(s[i+2:end], stack, refs)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			// keep unresolved expression, so the missing key can be spotted
+			b.WriteString(s[i : end+1])
+		} else if i == 0 && end == len(s)-1 {
+			return value, nil
+		} else {
+			b.WriteString(valueString(value))
+		}
+		i = end + 1
+	}
+	return b.String(), nil
+}
+
+// resolveExpression resolves a single expression (without ${ and }). Nil is returned if
+// referenced key is not found and expression has no default value.
+func (c Util) resolveExpression(expr string, stack []string, refs map[string]bool) (interface{}, error) {
+	key, def, hasDefault := expr, "", false
+	if i := defaultSeparator(expr); i >= 0 {
+		key, def, hasDefault = expr[:i], expr[i+1:], true
+	}
+	key = strings.TrimSpace(key)
+
+	for _, k := range stack {
+		if k == key {
+			return nil, fmt.Errorf("circular reference %s", strings.Join(append(stack, key), " -> "))
+		}
+	}
+	if refs != nil {
+		refs[key] = true
+	}
+
+	value := c.getRaw(key)
+	if value == nil {
+		if !hasDefault {
+			return nil, nil
+		}
+		return c.resolveString(def, stack, refs)
+	}
+	if s, ok := value.(string); ok {
+		return c.resolveString(s, append(stack[:len(stack):len(stack)], key), refs)
+	}
+	return value, nil
+}
+
+// expressionEnd returns the index of } closing an expression, which content starts at start, or
+// -1 if expression is not closed. Nested expressions (i.e. in default values) are skipped.
+func expressionEnd(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "${"):
+			depth++
+			i++
+		case s[i] == '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// defaultSeparator returns the index of colon separating key from default value in an
+// expression, or -1 if expression has no default value
+func defaultSeparator(expr string) int {
+	for i := 0; i < len(expr); i++ {
+		if strings.HasPrefix(expr[i:], "${") {
+			return -1
+		}
+		if expr[i] == ':' {
+			return i
+		}
+	}
+	return -1
+}
+
+// expressionWatch watches keys referenced in the value of a watched key and calls changed with
+// the configuration source, in which a referenced value has changed. Watched references are
+// refreshed on every change, as changed values can reference different keys.
+type expressionWatch struct {
+	util    Util
+	key     string
+	changed func(cs ConfigSource)
+
+	mu     sync.Mutex
+	closed bool
+	refs   map[string]Subscription
+}
+
+func newExpressionWatch(util Util, key string, changed func(cs ConfigSource)) *expressionWatch {
+	w := &expressionWatch{
+		util:    util,
+		key:     key,
+		changed: changed,
+		refs:    make(map[string]Subscription),
+	}
+	w.refresh()
+	return w
+}
+
+// refresh watches keys currently referenced in the value of the watched key and removes watches
+// of keys that are no longer referenced
+func (w *expressionWatch) refresh() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	refs := w.util.references(w.key)
+	for k, sub := range w.refs {
+		if !refs[k] {
+			sub.Unsubscribe()
+			delete(w.refs, k)
+		}
+	}
+	for k := range refs {
+		if _, ok := w.refs[k]; !ok {
+			w.refs[k] = w.util.subscribeSources(k, w.referenceChanged)
+		}
+	}
+}
+
+func (w *expressionWatch) referenceChanged(cs ConfigSource, key string, value string) {
+	w.refresh()
+	w.changed(cs)
+}
+
+func (w *expressionWatch) Unsubscribe() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	for k, sub := range w.refs {
+		sub.Unsubscribe()
+		delete(w.refs, k)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExpressions(t *testing.T) {
+	os.Setenv("DB_HOST", "db.example.com")
+	defer os.Unsetenv("DB_HOST")
+
+	source := mapConfigSource{"expressions", 50, map[string]interface{}{
+		"db.host":     "localhost",
+		"db.url":      "postgres://${db.host}:${db.port:5432}/app",
+		"db.port-ref": "${integer-value}",
+		"db.user":     "${db.missing}",
+		"escaped":     `\${db.host} is ${db.host}`,
+		"nested":      "${db.missing:${db.other:${string-value}}}",
+		"empty":       "${db.missing:}",
+		"unclosed":    "${db.host",
+		"cycle.a":     "a ${cycle.b}",
+		"cycle.b":     "b ${cycle.a}",
+		"self":        "${self:default}",
+	}}
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+
+	expected := map[string]interface{}{
+		// environment variable overrides db.host
+		"db.url": "postgres://db.example.com:5432/app",
+		// single expression keeps referenced type (numbers from YAML are float64)
+		"db.port-ref": float64(36),
+		// unresolved expression is kept
+		"db.user":  "${db.missing}",
+		"escaped":  "${db.host} is db.example.com",
+		"nested":   "hey ho",
+		"empty":    "",
+		"unclosed": "${db.host",
+		// circular references are not resolved
+		"cycle.a": "a ${cycle.b}",
+		"self":    "${self:default}",
+	}
+	for key, e := range expected {
+		if v := c.Get(key); v != e {
+			t.Errorf("%s: expected=%v, got=%v", key, e, v)
+		}
+	}
+
+	if i, ok := c.GetInt("db.port-ref"); !(ok && i == 36) {
+		t.Errorf("expected=%v, got=%v", 36, i)
+	}
+}
+
+func TestExpressionCircularReference(t *testing.T) {
+	source := mapConfigSource{"expressions", 400, map[string]interface{}{
+		"cycle.a":   "a ${cycle.b}",
+		"cycle.b":   "b ${cycle.a}",
+		"cycle.int": "${cycle.int}",
+		"cycle.ref": "${cycle.b:default}",
+	}}
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+
+	// typed getters report values with circular references as not found
+	for _, key := range []string{"cycle.a", "cycle.b", "cycle.int", "cycle.ref"} {
+		if s, ok := c.GetString(key); ok {
+			t.Errorf("%s: expected not found, got=%v", key, s)
+		}
+	}
+	if i, ok := c.GetInt("cycle.int"); ok || i != 0 {
+		t.Errorf("expected not found, got=%v", i)
+	}
+	if f, ok := c.GetFloat("cycle.int"); ok || f != 0 {
+		t.Errorf("expected not found, got=%v", f)
+	}
+	if b, ok := c.GetBool("cycle.int"); ok || b {
+		t.Errorf("expected not found, got=%v", b)
+	}
+
+	var bundle struct {
+		A string `config:"a"`
+	}
+	bundle.A = "unchanged"
+	NewBundle("cycle", &bundle, Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+	if bundle.A != "unchanged" {
+		t.Errorf("expected=%v, got=%v", "unchanged", bundle.A)
+	}
+}
+
+func TestExpressionWatch(t *testing.T) {
+	stub := newConsulStub(map[string]string{
+		"test/db/host": "localhost",
+		"test/db/url":  "postgres://${db.host}:${db.port:5432}/app",
+	})
+	defer stub.server.Close()
+
+	c := NewUtil(consulStubOptions(stub))
+	defer c.Close()
+
+	updates := make(chan string, 10)
+	sub := c.Subscribe("db.url", func(key string, value string) {
+		updates <- key + "=" + value
+	})
+
+	expectUpdate := func(expected string) {
+		select {
+		case u := <-updates:
+			if u != expected {
+				t.Errorf("expected=%v, got=%v", expected, u)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch was not fired")
+		}
+	}
+
+	// referenced key changes
+	stub.set("test/db/host", "db.example.com", false)
+	expectUpdate("db.url=postgres://db.example.com:5432/app")
+
+	// referenced key, that was missing, is added
+	stub.set("test/db/port", "5433", false)
+	expectUpdate("db.url=postgres://db.example.com:5433/app")
+
+	// watched key itself changes and references a new key
+	stub.set("test/db/url", "postgres://${db.host}/${db.name}", false)
+	expectUpdate("db.url=postgres://db.example.com/${db.name}")
+	stub.set("test/db/name", "app", false)
+	expectUpdate("db.url=postgres://db.example.com/app")
+
+	sub.Unsubscribe()
+	stub.set("test/db/host", "localhost", false)
+	select {
+	case u := <-updates:
+		t.Errorf("watch was fired after Unsubscribe: %s", u)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
@@ -22,83 +22,450 @@
 package config
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 
-	"github.com/ghodss/yaml"
+	"github.com/fsnotify/fsnotify"
 	"github.com/mc0239/logm"
 )
 
 type fileConfigSource struct {
-	config map[string]interface{}
-	logger *logm.Logm
+	ctx     context.Context
+	path    string
+	name    string
+	ordinal int
+	logger  *logm.Logm
+
+	mu          sync.RWMutex
+	config      map[string]interface{}
+	raw         []byte
+	subscribers subscribers
+	watchOnce   sync.Once
+}
+
+// newProfileConfigSource creates a configuration source for profile's configuration file on a
+// given path (see profilePath)
+func newProfileConfigSource(ctx context.Context, configPath string, profile string, ordinal int, lgr *logm.Logm) (ConfigSource, error) {
+	return newFileConfigSourceNamed(ctx, configPath, "file:"+profile, ordinal, lgr)
 }
 
-func newFileConfigSource(configPath string, lgr *logm.Logm) configSource {
-	var c fileConfigSource
+func newFileConfigSourceNamed(ctx context.Context, configPath string, name string, ordinal int, lgr *logm.Logm) (ConfigSource, error) {
+	c := &fileConfigSource{
+		ctx:         ctx,
+		path:        configPath,
+		name:        name,
+		ordinal:     ordinal,
+		subscribers: make(subscribers),
+	}
 	lgr.Verbose("Initializing %s config source", c.Name())
 	c.logger = lgr
 
-	var joinedPath string
-	if configPath == "" {
-		// set default
-		joinedPath = "config.yaml"
+	lgr.Verbose("Config file path: %s", configPath)
+
+	raw, config, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	c.raw = raw
+	c.config = config
+
+	lgr.Verbose("Initialized %s config source", c.Name())
+	return c, nil
+}
+
+func (c *fileConfigSource) Get(key string) interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return lookupFileConfig(c.config, key)
+}
+
+// Subscribe creates a watch on a given key. Configuration file is watched for changes once the
+// first watch is created.
+func (c *fileConfigSource) Subscribe(key string, callback func(key string, value string)) Subscription {
+	c.watchOnce.Do(func() {
+		if watcher, err := c.newWatcher(); err == nil {
+			realPath, _ := filepath.EvalSymlinks(c.path)
+			go c.watch(watcher, realPath)
+		} else {
+			c.logger.Warning("Failed to create a watch on file %s: %s", c.path, err.Error())
+		}
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := &subscriber{key, callback}
+	c.subscribers.add(key, s)
+
+	return SubscriptionFunc(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.subscribers.remove(key, s)
+	})
+}
+
+func (c *fileConfigSource) listSize(key string) (int, bool) {
+	if l, ok := c.Get(key).([]interface{}); ok {
+		return len(l), true
+	}
+	return 0, false
+}
+
+func (c *fileConfigSource) Keys(prefix string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var val interface{} = c.config
+	if prefix != "" {
+		val = lookupFileNode(c.config, prefix)
+	}
+	return fileConfigKeys(prefix, val, make([]string, 0))
+}
+
+func (c *fileConfigSource) mapKeys(prefix string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var m map[string]interface{}
+	if prefix == "" {
+		m = c.config
 	} else {
-		joinedPath = configPath
+		m, _ = lookupFileNode(c.config, prefix).(map[string]interface{})
 	}
 
-	lgr.Verbose(fmt.Sprintf("Config file path: %s\n", joinedPath))
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k != nodeValueKey {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (c *fileConfigSource) Name() string {
+	return c.name
+}
+
+func (c *fileConfigSource) Ordinal() int {
+	return c.ordinal
+}
+
+// functions that aren't configSource methods
 
-	bytes, err := ioutil.ReadFile(joinedPath)
+// read reads and parses the configuration file
+func (c *fileConfigSource) read() ([]byte, map[string]interface{}, error) {
+	decode, err := decoderFor(c.path)
 	if err != nil {
-		lgr.Error(fmt.Sprintf("Failed to read file on path: %s, error: %s", joinedPath, err.Error()))
-		return nil
+		return nil, nil, err
 	}
-	//fmt.Printf("Read: %s", bytes)
 
-	err = yaml.Unmarshal(bytes, &c.config)
+	raw, err := ioutil.ReadFile(c.path)
 	if err != nil {
-		lgr.Error(fmt.Sprintf("Failed tu unmarshal yaml: %s", err.Error()))
-		return nil
+		return nil, nil, fmt.Errorf("failed to read file on path %s: %s", c.path, err.Error())
 	}
+	//fmt.Printf("Read: %s", raw)
 
-	lgr.Verbose("Initialized %s config source", c.Name())
-	return c
+	config, err := decode(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode %s: %s", c.path, err.Error())
+	}
+
+	return raw, config, nil
 }
 
-func (c fileConfigSource) Get(key string) interface{} {
-	//fmt.Println("[fileConfigSource] Get: " + key)
-	tree := strings.Split(key, ".")
+// newWatcher creates a watcher on directory of the configuration file instead of the file itself,
+// so that replacements of the file (i.e. atomic symlink swaps of ConfigMaps mounted by
+// Kubernetes) are noticed as well
+func (c *fileConfigSource) newWatcher() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(c.path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	c.logger.Verbose("Set a watch on file %s", c.path)
+	return watcher, nil
+}
 
-	// move deeper into maps for every dot delimiter
-	val := c.config
-	var assertOk bool
-	for i := 0; i < len(tree)-1; i++ {
-		if val == nil {
-			return nil
+// watch reloads configuration file when it changes, until context is done. realPath is the path
+// configuration file resolved to when watcher was created.
+func (c *fileConfigSource) watch(watcher *fsnotify.Watcher, realPath string) {
+	defer watcher.Close()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.logger.Verbose("Watch on file %s stopped", c.path)
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// reload if the file itself changed or if it now resolves to a different file
+			currentPath, _ := filepath.EvalSymlinks(c.path)
+			if filepath.Clean(event.Name) == filepath.Clean(c.path) || currentPath != realPath {
+				realPath = currentPath
+				c.reload()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			c.logger.Warning("Watch on file %s failed with error: %s", c.path, err.Error())
 		}
-		val, assertOk = val[tree[i]].(map[string]interface{})
+	}
+}
 
-		if !assertOk {
-			return nil
+// reload re-reads the configuration file and fires callbacks for keys whose values changed
+func (c *fileConfigSource) reload() {
+	raw, config, err := c.read()
+	if err != nil {
+		// file may be in the middle of being replaced, keep previous configuration
+		c.logger.Verbose("Could not reload file: %s", err.Error())
+		return
+	}
+
+	var notifications []notification
+
+	c.mu.Lock()
+	if bytes.Equal(raw, c.raw) {
+		c.mu.Unlock()
+		return
+	}
+	for key, subs := range c.subscribers {
+		oldValue := lookupFileConfig(c.config, key)
+		newValue := lookupFileConfig(config, key)
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		for _, s := range subs {
+			notifications = append(notifications, notification{s, valueString(newValue)})
 		}
-		//fmt.Printf("%d ::: %v\n", i, val)
 	}
+	c.raw = raw
+	c.config = config
+	c.mu.Unlock()
 
-	return val[tree[len(tree)-1]]
+	c.logger.Info("Reloaded configuration file %s", c.path)
+
+	// callbacks are fired outside of lock, so they can call Get
+	notify(notifications)
 }
 
-func (c fileConfigSource) Subscribe(key string, callback func(key string, value string)) {
-	return
+// functions that aren't configSource methods or fileConfigSource methods
+
+// optionalPathPrefix marks configuration files that are skipped if they don't exist
+const optionalPathPrefix = "optional:"
+
+// configFile is a configuration file to be loaded as a separate configuration source
+type configFile struct {
+	path     string
+	name     string
+	ordinal  int
+	optional bool
 }
 
-func (c fileConfigSource) Name() string {
-	return "file"
+// configFiles returns configuration files from the highest to the lowest priority, along with
+// the path of the base configuration file, which profile files are placed next to. Files set
+// with Options.ConfigPaths are layered on top of the base file (see configFilePath) and have
+// decreasing ordinals, with 100 for the first one. If base file is not set and not found on the
+// search path, the last of Options.ConfigPaths is the base file instead. Base file is named
+// "file", while others are named "file:<path>".
+func configFiles(options Options, serviceName string, lgr *logm.Logm) ([]configFile, string, error) {
+	layers := options.ConfigPaths
+	basePath, optional := splitOptionalPath(options.ConfigPath)
+
+	basePath, err := configFilePath(basePath, serviceName, lgr)
+	if err != nil {
+		if len(layers) == 0 {
+			return nil, basePath, err
+		}
+		basePath, optional = splitOptionalPath(layers[len(layers)-1])
+		layers = layers[:len(layers)-1]
+		lgr.Info("Using configuration file %s, the last of layered configuration files", basePath)
+	}
+
+	files := make([]configFile, 0, len(layers)+1)
+	for _, layer := range layers {
+		path, layerOptional := splitOptionalPath(layer)
+		if sameFile(path, basePath) {
+			// base file is always the lowest layer
+			continue
+		}
+		files = append(files, configFile{path: path, name: "file:" + path, optional: layerOptional})
+	}
+	files = append(files, configFile{path: basePath, name: "file", optional: optional})
+
+	for i := range files {
+		files[i].ordinal = 100 - i
+	}
+	return files, basePath, nil
 }
 
-func (c fileConfigSource) ordinal() int {
-	return 100
+// splitOptionalPath removes the optional: prefix from a configuration file path and reports
+// whether it was present
+func splitOptionalPath(path string) (string, bool) {
+	if strings.HasPrefix(path, optionalPathPrefix) {
+		return strings.TrimPrefix(path, optionalPathPrefix), true
+	}
+	return path, false
 }
 
-//
+// sameFile reports whether two paths point to the same file
+func sameFile(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	ai, errA := os.Stat(a)
+	bi, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(ai, bi)
+}
+
+// configPathEnv is the environment variable that sets the path of the base configuration file,
+// when it is not set with Options.ConfigPath
+const configPathEnv = "KUMULUZEE_CONFIG_PATH"
+
+// configFilePath returns the path of the base configuration file: configPath if set, path from
+// KUMULUZEE_CONFIG_PATH environment variable or the first existing file on the search path (see
+// configFileCandidates). If no file is found, config.yaml is returned along with an error.
+func configFilePath(configPath string, serviceName string, lgr *logm.Logm) (string, error) {
+	if configPath != "" {
+		lgr.Info("Using configuration file %s, set in options", configPath)
+		return configPath, nil
+	}
+	if p, ok := os.LookupEnv(configPathEnv); ok && p != "" {
+		lgr.Info("Using configuration file %s, set with %s", p, configPathEnv)
+		return p, nil
+	}
+
+	candidates := configFileCandidates(serviceName)
+	for _, p := range candidates {
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			lgr.Info("Using configuration file %s, found on search path", p)
+			return p, nil
+		}
+		lgr.Verbose("Configuration file not found on path %s", p)
+	}
+	return "config.yaml", fmt.Errorf("configuration file not found, searched paths: %s (set Options.ConfigPath or %s)",
+		strings.Join(candidates, ", "), configPathEnv)
+}
+
+// configFileCandidates returns paths the base configuration file is searched on, in order: working
+// directory, config directory in working directory, directory of the executable and
+// /etc/<service-name>, each with config.yaml and config.yml
+func configFileCandidates(serviceName string) []string {
+	dirs := []string{".", "config"}
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	if serviceName != "" {
+		dirs = append(dirs, filepath.Join("/etc", serviceName))
+	}
+
+	candidates := make([]string, 0, 2*len(dirs))
+	for _, dir := range dirs {
+		candidates = append(candidates, filepath.Join(dir, "config.yaml"), filepath.Join(dir, "config.yml"))
+	}
+	return candidates
+}
+
+// profilePath returns the path of profile's configuration file, i.e. config-dev.yaml for base
+// path config.yaml and profile dev
+func profilePath(configPath string, profile string) string {
+	ext := filepath.Ext(configPath)
+	return strings.TrimSuffix(configPath, ext) + "-" + profile + ext
+}
+
+// profiles returns active configuration profiles: environment name (kumuluzee.env.name) followed
+// by profiles listed in kumuluzee.profiles, either as a list or a comma-separated string
+func profiles(conf Util) []string {
+	var names []string
+	if env, ok := conf.GetString("kumuluzee.env.name"); ok {
+		names = append(names, env)
+	}
+	return uniqueStrings(append(names, stringList(conf, "kumuluzee.profiles")...))
+}
+
+// nodeValueKey is the map key that holds the value of a key, which has nested keys as well (i.e.
+// logging.level in properties files that define both logging.level and logging.level.com.foo)
+const nodeValueKey = ""
+
+// lookupFileConfig returns the value of a given key in a configuration tree
+func lookupFileConfig(config map[string]interface{}, key string) interface{} {
+	val := lookupFileNode(config, key)
+	if m, ok := val.(map[string]interface{}); ok {
+		if v, ok := m[nodeValueKey]; ok {
+			return v
+		}
+	}
+	return val
+}
+
+// lookupFileNode returns the node of a given key in a configuration tree, which is a map for keys
+// with nested keys, even if they have a value as well
+func lookupFileNode(config map[string]interface{}, key string) interface{} {
+	//fmt.Println("[fileConfigSource] Get: " + key)
+	tree := strings.Split(key, ".")
+
+	// move deeper into maps for every dot delimiter and into lists for every index
+	var val interface{} = config
+	for _, part := range tree {
+		name, indices := splitKeyIndices(part)
+		if name == "" && len(indices) == 0 {
+			return nil
+		}
+
+		if name != "" {
+			m, ok := val.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			val = m[name]
+		}
+
+		for _, i := range indices {
+			l, ok := val.([]interface{})
+			if !ok || i >= len(l) {
+				return nil
+			}
+			val = l[i]
+		}
+		//fmt.Printf("%s ::: %v\n", part, val)
+	}
+
+	return val
+}
+
+// fileConfigKeys appends keys of all values in a configuration tree under a given key
+func fileConfigKeys(key string, value interface{}, keys []string) []string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			if name == nodeValueKey {
+				name = key
+			} else if key != "" {
+				name = key + "." + name
+			}
+			keys = fileConfigKeys(name, child, keys)
+		}
+	case []interface{}:
+		for i, child := range v {
+			keys = fileConfigKeys(fmt.Sprintf("%s[%d]", key, i), child, keys)
+		}
+	case nil:
+		// key is not present or has no value
+	default:
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -22,7 +22,12 @@
 package config
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func fileAssert(t *testing.T, expected interface{}, got interface{}) {
@@ -166,6 +171,35 @@ func TestFileConfigBundle(t *testing.T) {
 	}
 }
 
+func TestFileConfigBundleKeys(t *testing.T) {
+	type rootConfig struct {
+		StringValue string `config:"string-value"`
+		SomeConfig  struct {
+			Protocol string
+			Version  string `config:",watch"`
+		} `config:"some-config"`
+	}
+
+	rc := rootConfig{}
+
+	// empty prefix key reads fields from the root of configuration, tag without a name keeps the
+	// lower-cased field name as a key
+	NewBundle("", &rc, Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	if rc.StringValue != "hey ho" {
+		fileAssert(t, "hey ho", rc.StringValue)
+	}
+	if rc.SomeConfig.Protocol != "tcp" {
+		fileAssert(t, "tcp", rc.SomeConfig.Protocol)
+	}
+	if rc.SomeConfig.Version != "1.0.0" {
+		fileAssert(t, "1.0.0", rc.SomeConfig.Version)
+	}
+}
+
 func TestFileConfigDeep(t *testing.T) {
 	c := NewUtil(Options{
 		ConfigPath: "../test/config.yaml",
@@ -175,3 +209,647 @@ func TestFileConfigDeep(t *testing.T) {
 		fileAssert(t, 6, i)
 	}
 }
+
+func TestFileConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("a: 1\nb: 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewUtil(Options{
+		ConfigPath: path,
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	updates := make(chan string, 10)
+	c.Subscribe("a", func(key string, value string) {
+		updates <- key + "=" + value
+	})
+	c.Subscribe("b", func(key string, value string) {
+		updates <- key + "=" + value
+	})
+
+	if err := ioutil.WriteFile(path, []byte("a: 3\nb: 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case u := <-updates:
+		if u != "a=3" {
+			fileAssert(t, "a=3", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch was not fired")
+	}
+	if i, ok := c.GetInt("a"); !(ok && i == 3) {
+		fileAssert(t, 3, i)
+	}
+	select {
+	case u := <-updates:
+		// b did not change
+		t.Errorf("unexpected update %s", u)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestFileConfigReloadSymlinkSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// layout of a ConfigMap mounted by Kubernetes:
+	// config.yaml -> ..data/config.yaml, ..data -> ..v1
+	writeVersion := func(version string, content string) {
+		if err := os.Mkdir(filepath.Join(dir, version), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, version, "config.yaml"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("..v1", "a: 1\n")
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewUtil(Options{
+		ConfigPath: path,
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	updates := make(chan string, 10)
+	c.Subscribe("a", func(key string, value string) {
+		updates <- value
+	})
+
+	// atomically swap ..data symlink to a new version
+	writeVersion("..v2", "a: 2\n")
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(dir, "..v1"))
+
+	select {
+	case u := <-updates:
+		if u != "2" {
+			fileAssert(t, "2", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch was not fired")
+	}
+}
+
+func TestFileConfigList(t *testing.T) {
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+	if s, ok := c.GetString("yaml-array[1]"); !(ok && s == "entry2") {
+		fileAssert(t, "entry2", s)
+	}
+	if v := c.Get("yaml-array[4]"); v != nil {
+		fileAssert(t, nil, v)
+	}
+	if s, ok := c.GetString("servers[1].host"); !(ok && s == "10.0.0.2") {
+		fileAssert(t, "10.0.0.2", s)
+	}
+	if i, ok := c.GetInt("servers[0].port"); !(ok && i == 8080) {
+		fileAssert(t, 8080, i)
+	}
+	if s, ok := c.GetString("servers[1].tags[1]"); !(ok && s == "eu") {
+		fileAssert(t, "eu", s)
+	}
+
+	if n, ok := c.GetListSize("yaml-array"); !(ok && n == 4) {
+		fileAssert(t, 4, n)
+	}
+	if n, ok := c.GetListSize("servers"); !(ok && n == 2) {
+		fileAssert(t, 2, n)
+	}
+	if n, ok := c.GetListSize("servers[1].tags"); !(ok && n == 2) {
+		fileAssert(t, 2, n)
+	}
+	if n, ok := c.GetListSize("some-config"); !(!ok && n == 0) {
+		// map is not a list
+		fileAssert(t, 0, n)
+	}
+}
+
+func TestFileConfigBundleList(t *testing.T) {
+	type server struct {
+		Host string
+		Port int
+		Tags []string
+	}
+	type listConfig struct {
+		YamlArray  []string  `config:"yaml-array"`
+		FirstTwo   [2]string `config:"yaml-array"`
+		Servers    []server
+		NotAList   []int `config:"integer-value"`
+		NotPresent []string
+	}
+
+	lc := listConfig{NotAList: []int{1}}
+
+	NewBundle("", &lc, Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	if !reflect.DeepEqual(lc.YamlArray, []string{"entry1", "entry2", "entry3", "entry4"}) {
+		fileAssert(t, []string{"entry1", "entry2", "entry3", "entry4"}, lc.YamlArray)
+	}
+	if lc.FirstTwo != [2]string{"entry1", "entry2"} {
+		fileAssert(t, [2]string{"entry1", "entry2"}, lc.FirstTwo)
+	}
+	expected := []server{
+		{"10.0.0.1", 8080, nil},
+		{"10.0.0.2", 8081, []string{"primary", "eu"}},
+	}
+	if !reflect.DeepEqual(lc.Servers, expected) {
+		fileAssert(t, expected, lc.Servers)
+	}
+	if !reflect.DeepEqual(lc.NotAList, []int{1}) {
+		// non-list value is ignored
+		fileAssert(t, []int{1}, lc.NotAList)
+	}
+	if lc.NotPresent != nil {
+		fileAssert(t, nil, lc.NotPresent)
+	}
+}
+
+func TestFileConfigBundleMap(t *testing.T) {
+	type tenant struct {
+		Quota int
+		Name  string
+	}
+	type mapConfig struct {
+		Tenants    map[string]tenant
+		Quotas     map[string]int    `config:"tenants.acme"`
+		Protocols  map[string]string `config:"some-config"`
+		NotPresent map[string]string
+	}
+
+	var mc mapConfig
+	NewBundle("", &mc, Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	expected := map[string]tenant{
+		"acme": {100, "Acme Inc."},
+		"corp": {250, "Corp Ltd."},
+	}
+	if !reflect.DeepEqual(mc.Tenants, expected) {
+		fileAssert(t, expected, mc.Tenants)
+	}
+	if !reflect.DeepEqual(mc.Quotas, map[string]int{"quota": 100}) {
+		// name is not an integer
+		fileAssert(t, map[string]int{"quota": 100}, mc.Quotas)
+	}
+	expectedProtocols := map[string]string{"protocol": "tcp", "version": "1.0.0"}
+	if !reflect.DeepEqual(mc.Protocols, expectedProtocols) {
+		// address subtree and boolean are skipped
+		fileAssert(t, expectedProtocols, mc.Protocols)
+	}
+	if mc.NotPresent != nil {
+		fileAssert(t, nil, mc.NotPresent)
+	}
+}
+
+func TestFileConfigProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"app.yaml":         "kumuluzee:\n  env:\n    name: dev\na: base\nb: base\nc: base\nd: base\n",
+		"app-dev.yaml":     "a: dev\nb: dev\nc: dev\n",
+		"app-eu.yaml":      "a: eu\nb: eu\n",
+		"app-canary.yaml":  "a: canary\n",
+		"config-dev.yaml":  "d: wrong base name\n",
+		"app-unused.yaml":  "d: unused\n",
+		"app-broken.yaml":  "a: [\n",
+		"app-missing.yaml": "",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(filepath.Join(dir, "app-missing.yaml"))
+
+	os.Setenv("KUMULUZEE_PROFILES", "eu, missing,canary")
+	defer os.Unsetenv("KUMULUZEE_PROFILES")
+
+	c := NewUtil(Options{
+		ConfigPath: filepath.Join(dir, "app.yaml"),
+		LogLevel:   100, // turn off logging
+	})
+
+	expected := map[string]string{"a": "canary", "b": "eu", "c": "dev", "d": "base"}
+	for key, e := range expected {
+		if s, ok := c.GetString(key); !(ok && s == e) {
+			fileAssert(t, e, s)
+		}
+	}
+
+	names := make([]string, 0)
+	for _, cs := range c.configSources {
+		if cs.Ordinal() > 100 && cs.Ordinal() < 150 {
+			names = append(names, cs.Name())
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"file:canary", "file:eu", "file:dev"}) {
+		fileAssert(t, []string{"file:canary", "file:eu", "file:dev"}, names)
+	}
+
+	os.Setenv("KUMULUZEE_PROFILES", "broken")
+	if _, err := NewUtilE(Options{
+		ConfigPath: filepath.Join(dir, "app.yaml"),
+		LogLevel:   100, // turn off logging
+	}); err == nil || err.(*SourceError).Source != "file:broken" {
+		fileAssert(t, "file:broken", err)
+	}
+}
+
+func TestFileConfigSearchPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	write := func(path string, value string) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte("string-value: "+value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertValue := func(expected string) {
+		c, err := NewUtilE(Options{
+			LogLevel: 100, // turn off logging
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, _ := c.GetString("string-value"); s != expected {
+			fileAssert(t, expected, s)
+		}
+	}
+
+	// no configuration file on search path
+	_, err = NewUtilE(Options{
+		LogLevel: 100, // turn off logging
+	})
+	if serr, ok := err.(*SourceError); !ok || serr.Source != "file" {
+		t.Fatalf("expected file source error, got=%v", err)
+	}
+
+	write(filepath.Join("config", "config.yml"), "config dir")
+	assertValue("config dir")
+
+	write("config.yml", "working dir yml")
+	assertValue("working dir yml")
+
+	write("config.yaml", "working dir yaml")
+	assertValue("working dir yaml")
+
+	// environment variable takes precedence over search path
+	write(filepath.Join("other", "app.yaml"), "env")
+	os.Setenv("KUMULUZEE_CONFIG_PATH", filepath.Join("other", "app.yaml"))
+	defer os.Unsetenv("KUMULUZEE_CONFIG_PATH")
+	assertValue("env")
+
+	// path set in options takes precedence over environment variable
+	c := NewUtil(Options{
+		ConfigPath: filepath.Join("config", "config.yml"),
+		LogLevel:   100, // turn off logging
+	})
+	if s, _ := c.GetString("string-value"); s != "config dir" {
+		fileAssert(t, "config dir", s)
+	}
+}
+
+func TestConfigFileCandidates(t *testing.T) {
+	candidates := configFileCandidates("customer-service")
+	if len(candidates) != 8 {
+		t.Fatalf("expected=%v, got=%v", 8, candidates)
+	}
+	expected := []string{"config.yaml", "config.yml", filepath.Join("config", "config.yaml"), filepath.Join("config", "config.yml")}
+	if !reflect.DeepEqual(candidates[:4], expected) {
+		fileAssert(t, expected, candidates[:4])
+	}
+	if candidates[6] != "/etc/customer-service/config.yaml" || candidates[7] != "/etc/customer-service/config.yml" {
+		fileAssert(t, "/etc/customer-service/config.yaml", candidates[6:])
+	}
+
+	if candidates := configFileCandidates(""); len(candidates) != 6 {
+		t.Errorf("expected=%v, got=%v", 6, candidates)
+	}
+}
+
+func TestFileConfigLayered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.yaml": "db:\n  host: localhost\n  port: 5432\n  pool:\n    size: 5\nservers:\n  - a\n  - b\n",
+		"common.yaml": "db:\n  host: db.internal\n  pool:\n    timeout: 30\nteam: payments\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := filepath.Join(dir, "config.yaml")
+	common := filepath.Join(dir, "common.yaml")
+	override := filepath.Join(dir, "override.yaml")
+
+	c, err := NewUtilE(Options{
+		ConfigPaths: []string{"optional:" + override, common, base},
+		LogLevel:    100, // turn off logging
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, _ := c.GetString("db.host"); s != "db.internal" {
+		fileAssert(t, "db.internal", s)
+	}
+	if i, _ := c.GetInt("db.port"); i != 5432 {
+		fileAssert(t, 5432, i)
+	}
+	expected := map[string]interface{}{
+		"host": "db.internal",
+		"port": float64(5432),
+		"pool": map[string]interface{}{"size": float64(5), "timeout": float64(30)},
+	}
+	if db := c.Get("db"); !reflect.DeepEqual(db, expected) {
+		fileAssert(t, expected, db)
+	}
+	if keys := c.Keys("db.pool"); !reflect.DeepEqual(keys, []string{"db.pool.size", "db.pool.timeout"}) {
+		fileAssert(t, []string{"db.pool.size", "db.pool.timeout"}, keys)
+	}
+	if keys, _ := c.GetMapKeys(""); !reflect.DeepEqual(keys, []string{"db", "servers", "team"}) {
+		fileAssert(t, []string{"db", "servers", "team"}, keys)
+	}
+
+	// without ConfigPath and a file on the search path, the last file is the base file; skipped
+	// optional file keeps its ordinal, so that ordinals of other files don't depend on its presence
+	if o := c.ordinal(c.sourceByName(t, "file:"+common)); o != 99 {
+		fileAssert(t, 99, o)
+	}
+	if o := c.ordinal(c.sourceByName(t, "file")); o != 98 {
+		fileAssert(t, 98, o)
+	}
+
+	// base file set with ConfigPath is the lowest layer, and is not loaded twice
+	c = NewUtil(Options{
+		ConfigPath:  base,
+		ConfigPaths: []string{common, base},
+		LogLevel:    100, // turn off logging
+	})
+	if len(c.configSources) != 3 {
+		t.Errorf("expected=%v, got=%v", 3, len(c.configSources))
+	}
+	if o := c.ordinal(c.sourceByName(t, "file")); o != 99 {
+		fileAssert(t, 99, o)
+	}
+
+	// ordinal of the base file can be overridden
+	c = NewUtil(Options{
+		ConfigPaths: []string{common, base},
+		Ordinals:    map[string]int{"file": 101},
+		LogLevel:    100, // turn off logging
+	})
+	if s, _ := c.GetString("db.host"); s != "localhost" {
+		fileAssert(t, "localhost", s)
+	}
+
+	// missing files that are not optional fail to load
+	_, err = NewUtilE(Options{
+		ConfigPaths: []string{override, base},
+		LogLevel:    100, // turn off logging
+	})
+	if serr, ok := err.(*SourceError); !ok || serr.Source != "file:"+override {
+		t.Errorf("expected file:%s source error, got=%v", override, err)
+	}
+}
+
+func TestFileConfigLayeredLists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.yaml":       "servers:\n  - host: a\n  - host: b\n  - host: c\n",
+		"override.yaml":     "servers:\n  - host: z\n",
+		"profiles.yaml":     "kumuluzee:\n  env:\n    name: dev\nservers:\n  - host: a\n  - host: b\n",
+		"profiles-dev.yaml": "servers:\n  - host: z\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type server struct {
+		Host string
+	}
+	type serversConfig struct {
+		Servers []server
+	}
+
+	// list from a source with higher ordinal replaces the whole list, elements of the longer list
+	// from the base file are not merged into it
+	assertServers := func(c Util, sc serversConfig) {
+		expected := []interface{}{map[string]interface{}{"host": "z"}}
+		if servers := c.Get("servers"); !reflect.DeepEqual(servers, expected) {
+			fileAssert(t, expected, servers)
+		}
+		if n, ok := c.GetListSize("servers"); !(ok && n == 1) {
+			fileAssert(t, 1, n)
+		}
+		if s, ok := c.GetString("servers[0].host"); !(ok && s == "z") {
+			fileAssert(t, "z", s)
+		}
+		if s, ok := c.GetString("servers[1].host"); ok {
+			fileAssert(t, nil, s)
+		}
+		if keys := c.Keys("servers"); !reflect.DeepEqual(keys, []string{"servers[0].host"}) {
+			fileAssert(t, []string{"servers[0].host"}, keys)
+		}
+		if !reflect.DeepEqual(sc.Servers, []server{{"z"}}) {
+			fileAssert(t, []server{{"z"}}, sc.Servers)
+		}
+	}
+
+	// layered file
+	layered := Options{
+		ConfigPaths: []string{filepath.Join(dir, "override.yaml"), filepath.Join(dir, "config.yaml")},
+		LogLevel:    100, // turn off logging
+	}
+	var sc serversConfig
+	NewBundle("", &sc, layered)
+	assertServers(NewUtil(layered), sc)
+
+	// profile overlay
+	profiles := Options{
+		ConfigPath: filepath.Join(dir, "profiles.yaml"),
+		LogLevel:   100, // turn off logging
+	}
+	var pc serversConfig
+	NewBundle("", &pc, profiles)
+	assertServers(NewUtil(profiles), pc)
+}
+
+func TestFileConfigBundleShorterList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	override := filepath.Join(dir, "override.yaml")
+	if err := ioutil.WriteFile(override, []byte("servers:\n  - host: z\n  - host: v\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SERVERS_0_HOST", "x")
+	os.Setenv("SERVERS_2_HOST", "w")
+	defer os.Unsetenv("SERVERS_0_HOST")
+	defer os.Unsetenv("SERVERS_2_HOST")
+
+	type server struct {
+		Host string
+		Tags []string
+	}
+	var bundle struct {
+		Servers   []server
+		YamlArray []string `config:"yaml-array"`
+	}
+	NewBundle("", &bundle, Options{
+		ConfigPaths: []string{override, "../test/config.yaml"},
+		LogLevel:    100, // turn off logging
+	})
+
+	// list from override is shorter than the one in base file: environment variables override its
+	// elements, but don't extend it, and tags of the second server in base file are hidden
+	expected := []server{{"x", nil}, {"v", nil}}
+	if !reflect.DeepEqual(bundle.Servers, expected) {
+		fileAssert(t, expected, bundle.Servers)
+	}
+	if len(bundle.YamlArray) != 4 {
+		fileAssert(t, 4, len(bundle.YamlArray))
+	}
+}
+
+func TestFileConfigLayeredProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.yaml":     "kumuluzee:\n  env:\n    name: dev\nbase: config\nteam: config\nprofile: config\n",
+		"config-dev.yaml": "profile: config-dev\n",
+		"common.yaml":     "team: common\nprofile: common\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertValues := func(c Util) {
+		expected := map[string]string{"base": "config", "team": "common", "profile": "config-dev"}
+		for key, value := range expected {
+			if s, _ := c.GetString(key); s != value {
+				t.Errorf("key=%s expected=%v, got=%v", key, value, s)
+			}
+		}
+		if o := c.ordinal(c.sourceByName(t, "file:dev")); o != 110 {
+			fileAssert(t, 110, o)
+		}
+	}
+
+	// profiles are loaded next to the base file, not next to the (missing) first file
+	c, err := NewUtilE(Options{
+		ConfigPaths: []string{
+			"optional:" + filepath.Join(dir, "override.yaml"),
+			filepath.Join(dir, "common.yaml"),
+			filepath.Join(dir, "config.yaml"),
+		},
+		LogLevel: 100, // turn off logging
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValues(c)
+
+	// base file is found on the search path
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	c, err = NewUtilE(Options{
+		ConfigPaths: []string{"optional:override.yaml", "common.yaml"},
+		LogLevel:    100, // turn off logging
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValues(c)
+	if c.sourceByName(t, "file").(*fileConfigSource).path != "config.yaml" {
+		fileAssert(t, "config.yaml", c.sourceByName(t, "file").(*fileConfigSource).path)
+	}
+}
+
+// sourceByName returns a configuration source with a given name
+func (c Util) sourceByName(t *testing.T, name string) ConfigSource {
+	for _, cs := range c.configSources {
+		if cs.Name() == name {
+			return cs
+		}
+	}
+	t.Fatalf("configuration source %s not found", name)
+	return nil
+}
@@ -22,7 +22,9 @@
 package config
 
 import (
+	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -58,59 +60,225 @@ func traverseStruct(s interface{}, prefixKey string, fieldProcessFunc func(key s
 	}
 }
 
+// copyStruct returns a pointer to a shallow copy of the struct that ptr points to
+func copyStruct(ptr reflect.Value) reflect.Value {
+	c := reflect.New(ptr.Elem().Type())
+	c.Elem().Set(ptr.Elem())
+	return c
+}
+
 func retrieveKey(prefixKey string, field reflect.StructField, tags reflect.StructTag) string {
 	// building key: if config tag is defined and has non-empty first value,
 	// use prefixKey + tag, otherwise, use prefixKey + lowercased field name
-	var key string
+	var name string
 
 	if tag, ok := tags.Lookup("config"); ok {
-		tvs := strings.Split(tag, ",")
-		if tvs[0] != "" {
-			key = prefixKey + "." + tvs[0]
-		}
-	} else {
+		name = strings.Split(tag, ",")[0]
+	}
+	if name == "" {
 		r, n := utf8.DecodeRuneInString(field.Name)
-		lkey := string(unicode.ToLower(r)) + field.Name[n:]
-		key = prefixKey + "." + lkey
+		name = string(unicode.ToLower(r)) + field.Name[n:]
 	}
 
-	return key
+	// empty prefixKey means keys at the root of configuration
+	if prefixKey == "" {
+		return name
+	}
+	return prefixKey + "." + name
 }
 
 func setValueWithReflect(key string, value reflect.Value, field reflect.StructField, bun Bundle) {
-	switch field.Type.Kind() {
+	if !setValue(key, value, bun) {
+		bun.Logger.Warning("Field %s could not be properly reflected, ignoring.", key)
+	}
+}
+
+// setValue sets value from configuration for a given key. It returns false if value is of
+// unsupported type.
+func setValue(key string, value reflect.Value, bun Bundle) bool {
+	switch value.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Float32, reflect.Float64:
+		setScalarValue(key, value, bun)
+		break
+	case reflect.Struct:
+		traverseStruct(value, key,
+			func(k string, v reflect.Value, f reflect.StructField, tags reflect.StructTag) {
+				setValueWithReflect(k, v, f, bun)
+			},
+		)
+		break
+	case reflect.Slice:
+		fallthrough
+	case reflect.Array:
+		return setListValue(key, value, bun)
+	case reflect.Map:
+		return setMapValue(key, value, bun)
+	default:
+		return false
+	}
+	return true
+}
+
+// setScalarValue sets a boolean, string or numeric value from configuration for a given key. It
+// returns false if key was not found or its value could not be converted.
+func setScalarValue(key string, value reflect.Value, bun Bundle) bool {
+	switch value.Kind() {
 	case reflect.Bool:
-		if val, ok := bun.conf.GetBool(key); ok {
-			value.Set(reflect.ValueOf(val))
+		val, ok := bun.conf.GetBool(key)
+		if ok {
+			value.SetBool(val)
 		}
-		break
+		return ok
 	case reflect.String:
-		if val, ok := bun.conf.GetString(key); ok {
-			value.Set(reflect.ValueOf(val))
+		val, ok := bun.conf.GetString(key)
+		if ok {
+			value.SetString(val)
 		}
-		break
-	case reflect.Int:
-		fallthrough
-	case reflect.Int8:
-		fallthrough
-	case reflect.Int16:
-		fallthrough
-	case reflect.Int32:
-		fallthrough
-	case reflect.Int64:
-		if val, ok := bun.conf.GetInt(key); ok {
-			value.Set(reflect.ValueOf(val))
+		return ok
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		val, ok := bun.conf.GetInt(key)
+		if ok {
+			value.SetInt(int64(val))
 		}
-		break
-	case reflect.Float32:
-		fallthrough
-	case reflect.Float64:
-		if val, ok := bun.conf.GetFloat(key); ok {
-			value.Set(reflect.ValueOf(val))
+		return ok
+	case reflect.Float32, reflect.Float64:
+		val, ok := bun.conf.GetFloat(key)
+		if ok {
+			value.SetFloat(val)
 		}
+		return ok
+	}
+	return false
+}
+
+// setListValue fills a slice or an array with list elements from configuration, i.e. YAML
+// sequence or indexed keys, or with comma-separated values (i.e. from an environment variable).
+// The configuration source with the highest ordinal, that defines either of them, is used. Lists
+// are sized and their elements retrieved through Util, so that lists hidden by a whole list from
+// a source with higher ordinal are skipped and indexed keys only override elements within it.
+func setListValue(key string, value reflect.Value, bun Bundle) bool {
+	elemKind := value.Type().Elem().Kind()
+	switch elemKind {
+	case reflect.Bool, reflect.String, reflect.Struct,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Float32, reflect.Float64:
 		break
 	default:
-		bun.Logger.Warning("Field %s could not be properly reflected, ignoring.", key)
+		return false
+	}
+
+	for _, cs := range bun.conf.visibleSources(key) {
+		if s, ok := bun.conf.resolve(key, cs.Get(key)).(string); ok && elemKind != reflect.Struct {
+			parts := make([]string, 0)
+			if strings.TrimSpace(s) != "" {
+				parts = strings.Split(s, ",")
+			}
+
+			list := newList(value.Type(), len(parts))
+			for i := 0; i < len(parts) && i < list.Len(); i++ {
+				if !setValueFromString(list.Index(i), strings.TrimSpace(parts[i])) {
+					bun.Logger.Warning("Value %s of field %s could not be converted, ignoring.", parts[i], key)
+					return true
+				}
+			}
+			value.Set(list)
+			return true
+		}
+
+		if _, ok := sourceListSize(cs, key); ok {
+			// size is taken from the highest source defining the whole list, which can be lower
+			// than cs, and elements can be overridden in other sources, so both are retrieved
+			// through Util
+			size, _ := bun.conf.GetListSize(key)
+			list := newList(value.Type(), size)
+			for i := 0; i < size && i < list.Len(); i++ {
+				setValue(fmt.Sprintf("%s[%d]", key, i), list.Index(i), bun)
+			}
+			value.Set(list)
+			return true
+		}
+	}
+
+	return true
+}
+
+// setMapValue fills a map with string keys with entries of a configuration subtree under a given
+// key. Map keys are discovered in all configuration sources.
+func setMapValue(key string, value reflect.Value, bun Bundle) bool {
+	mapType := value.Type()
+	elemType := mapType.Elem()
+	if mapType.Key().Kind() != reflect.String {
+		return false
+	}
+	switch elemType.Kind() {
+	case reflect.Bool, reflect.String, reflect.Struct, reflect.Slice,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Float32, reflect.Float64:
 		break
+	default:
+		return false
+	}
+
+	keys, _ := bun.conf.GetMapKeys(key)
+	if len(keys) == 0 && value.IsNil() {
+		return true
+	}
+
+	m := reflect.MakeMapWithSize(mapType, len(keys))
+	for _, k := range keys {
+		entryKey := key + "." + k
+		elem := reflect.New(elemType).Elem()
+
+		switch elemType.Kind() {
+		case reflect.Struct, reflect.Slice:
+			setValue(entryKey, elem, bun)
+		default:
+			// skip entries that are subtrees or otherwise can't be converted
+			if !setScalarValue(entryKey, elem, bun) {
+				continue
+			}
+		}
+		m.SetMapIndex(reflect.ValueOf(k).Convert(mapType.Key()), elem)
+	}
+	value.Set(m)
+	return true
+}
+
+// newList returns a new slice of a given size or a new array, if listType is an array type
+func newList(listType reflect.Type, size int) reflect.Value {
+	if listType.Kind() == reflect.Array {
+		return reflect.New(listType).Elem()
+	}
+	return reflect.MakeSlice(listType, size, size)
+}
+
+// setValueFromString parses a string to value's type and sets it
+func setValueFromString(value reflect.Value, s string) bool {
+	switch value.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return false
+		}
+		value.SetBool(b)
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return false
+		}
+		value.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return false
+		}
+		value.SetFloat(f)
+	default:
+		return false
 	}
+	return true
 }
@@ -0,0 +1,113 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"sync"
+)
+
+// namespaceCache is a local copy of all key-value pairs in a namespace of a key-value store, with
+// keys relative to namespace. It is used by config sources that load the whole namespace at once
+// and keep it up to date with a single watch.
+type namespaceCache struct {
+	mu          sync.RWMutex
+	values      map[string]string
+	subscribers subscribers
+}
+
+func newNamespaceCache() *namespaceCache {
+	return &namespaceCache{
+		values:      make(map[string]string),
+		subscribers: make(subscribers),
+	}
+}
+
+func (c *namespaceCache) Get(key string) interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if value, ok := c.values[keyPath(key)]; ok {
+		return value
+	}
+	return nil
+}
+
+// Keys returns keys from the local copy of the namespace, which is kept current by the watch
+func (c *namespaceCache) Keys(prefix string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return keysFromPaths(c.values, keyPath(prefix))
+}
+
+func (c *namespaceCache) listSize(key string) (int, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return listSizeFromPaths(c.values, keyPath(key))
+}
+
+func (c *namespaceCache) mapKeys(prefix string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return mapKeysFromPaths(c.values, keyPath(prefix))
+}
+
+// subscribe adds a callback that is fired when value of a given key or any key under it changes
+func (c *namespaceCache) subscribe(key string, callback func(key string, value string)) Subscription {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := keyPath(key)
+	s := &subscriber{key, callback}
+	c.subscribers.add(p, s)
+
+	return SubscriptionFunc(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.subscribers.remove(p, s)
+	})
+}
+
+// snapshot returns a copy of local key-value pairs
+func (c *namespaceCache) snapshot() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	values := make(map[string]string, len(c.values))
+	for k, v := range c.values {
+		values[k] = v
+	}
+	return values
+}
+
+// update replaces local copy of key-value pairs and fires callbacks for keys whose values changed
+func (c *namespaceCache) update(values map[string]string) {
+	c.mu.Lock()
+	notifications := c.subscribers.changed(c.values, values)
+	c.values = values
+	c.mu.Unlock()
+
+	// callbacks are fired outside of lock, so they can call Get
+	notify(notifications)
+}
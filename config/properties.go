@@ -0,0 +1,255 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// decodeProperties decodes a Java .properties file (see java.util.Properties.load). Keys like
+// a.b.c and list[0] are decoded to nested maps and lists, so that they can be retrieved in the
+// same way as from YAML files. All values are strings.
+func decodeProperties(data []byte) (map[string]interface{}, error) {
+	config := make(map[string]interface{})
+
+	for _, line := range propertiesLines(string(data)) {
+		key, value, err := parsePropertiesLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		path, err := propertyPath(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := insertProperty(config, path, value, key); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// propertiesLines splits data to logical lines. Blank lines and comments are skipped, while
+// lines ending with an odd number of backslashes are joined with the following line, without its
+// leading whitespace.
+func propertiesLines(data string) []string {
+	natural := strings.Split(strings.Replace(strings.Replace(data, "\r\n", "\n", -1), "\r", "\n", -1), "\n")
+
+	var lines []string
+	var logical strings.Builder
+	continued := false
+	for _, line := range natural {
+		line = strings.TrimLeft(line, " \t\f")
+		if !continued && (line == "" || line[0] == '#' || line[0] == '!') {
+			continue
+		}
+
+		backslashes := len(line) - len(strings.TrimRight(line, `\`))
+		continued = backslashes%2 == 1
+		if continued {
+			line = line[:len(line)-1]
+		}
+		logical.WriteString(line)
+
+		if !continued {
+			lines = append(lines, logical.String())
+			logical.Reset()
+		}
+	}
+	if logical.Len() > 0 {
+		lines = append(lines, logical.String())
+	}
+	return lines
+}
+
+// parsePropertiesLine splits a logical line to an unescaped key and value. Key ends with the
+// first unescaped '=', ':' or whitespace.
+func parsePropertiesLine(line string) (key string, value string, err error) {
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if strings.IndexByte("=: \t\f", line[i]) >= 0 {
+			end = i
+			break
+		}
+	}
+
+	rest := strings.TrimLeft(line[end:], " \t\f")
+	if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+
+	if key, err = unescapeProperty(line[:end]); err != nil {
+		return "", "", err
+	}
+	if value, err = unescapeProperty(rest); err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+// unescapeProperty replaces escape sequences (\t, \n, \r, \f, \uXXXX) with characters they
+// represent. Backslash before any other character is dropped.
+func unescapeProperty(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if i+5 > len(s) {
+				return "", fmt.Errorf("malformed \\uxxxx encoding in %s", s)
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			if err != nil {
+				return "", fmt.Errorf("malformed \\uxxxx encoding in %s", s)
+			}
+			i += 4
+
+			// characters outside of the basic plane are encoded as surrogate pairs
+			if utf16High(rune(r)) && strings.HasPrefix(s[i+1:], `\u`) && i+7 <= len(s) {
+				if low, err := strconv.ParseUint(s[i+3:i+7], 16, 16); err == nil && utf16Low(rune(low)) {
+					r = uint64((rune(r)-0xd800)<<10|(rune(low)-0xdc00)) + 0x10000
+					i += 6
+				}
+			}
+			b.WriteRune(rune(r))
+		default:
+			r, size := utf8.DecodeRuneInString(s[i:])
+			b.WriteRune(r)
+			i += size - 1
+		}
+	}
+	return b.String(), nil
+}
+
+func utf16High(r rune) bool {
+	return r >= 0xd800 && r < 0xdc00
+}
+
+func utf16Low(r rune) bool {
+	return r >= 0xdc00 && r < 0xe000
+}
+
+// propertyPath splits a key to map keys (strings) and list indices (ints), i.e. servers[0].host
+// to servers, 0 and host
+func propertyPath(key string) ([]interface{}, error) {
+	var path []interface{}
+	for _, part := range strings.Split(key, ".") {
+		name, indices := splitKeyIndices(part)
+		if name == "" && (len(indices) == 0 || len(path) == 0) {
+			return nil, fmt.Errorf("invalid property key %s", key)
+		}
+		if name != "" {
+			path = append(path, name)
+		}
+		for _, i := range indices {
+			path = append(path, i)
+		}
+	}
+	return path, nil
+}
+
+// maxPropertyListGap limits how far beyond the current end of a list an index can be, so that a
+// single key like list[4000000000] can't allocate a huge list
+const maxPropertyListGap = 1024
+
+// insertProperty sets value on a given path under node, creating maps and lists on the way, and
+// returns the updated node. Keys that have a value and nested keys at the same time (i.e.
+// logging.level and logging.level.com.foo) keep their value in the map of nested keys (see
+// nodeValueKey).
+func insertProperty(node interface{}, path []interface{}, value string, key string) (interface{}, error) {
+	if len(path) == 0 {
+		switch n := node.(type) {
+		case nil, string:
+			// later definitions override earlier ones
+			return value, nil
+		case map[string]interface{}:
+			n[nodeValueKey] = value
+			return n, nil
+		default:
+			return nil, fmt.Errorf("property %s conflicts with list elements %s[...]", key, key)
+		}
+	}
+
+	switch step := path[0].(type) {
+	case string:
+		var m map[string]interface{}
+		switch n := node.(type) {
+		case nil:
+			m = make(map[string]interface{})
+		case string:
+			m = map[string]interface{}{nodeValueKey: n}
+		case map[string]interface{}:
+			m = n
+		default:
+			return nil, fmt.Errorf("property %s conflicts with another property on %s", key, step)
+		}
+		child, err := insertProperty(m[step], path[1:], value, key)
+		if err != nil {
+			return nil, err
+		}
+		m[step] = child
+		return m, nil
+	default:
+		i := step.(int)
+		l, ok := node.([]interface{})
+		if node != nil && !ok {
+			return nil, fmt.Errorf("property %s conflicts with another property on index [%d]", key, i)
+		}
+		if i > len(l)+maxPropertyListGap {
+			return nil, fmt.Errorf("index [%d] of property %s is too large, list has %d elements", i, key, len(l))
+		}
+		for len(l) <= i {
+			l = append(l, nil)
+		}
+		child, err := insertProperty(l[i], path[1:], value, key)
+		if err != nil {
+			return nil, err
+		}
+		l[i] = child
+		return l, nil
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPropertiesConfigFile(t *testing.T) {
+	c, err := NewUtilE(Options{
+		ConfigPath: "../test/config.properties",
+		LogLevel:   100, // turn off logging
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strs := map[string]string{
+		"string-value":                "Hello world",
+		"some-config.address.ip":      "127.0.0.2",
+		"servers[1].host":             "example.com",
+		"escaped key=with:separators": "escaped value",
+		"multiline-value":             "first, second, third",
+		"unicode-value":               "café 😀",
+		"special-value":               "tab\there\nnew line \\ backslash",
+		"empty-value":                 "",
+		"logging.level":               "INFO",
+		"logging.level.com.foo":       "DEBUG",
+		"some-config.address.port":    "8080",
+	}
+	for key, expected := range strs {
+		if s, ok := c.GetString(key); !(ok && s == expected) {
+			t.Errorf("key=%s expected=%q, got=%q", key, expected, s)
+		}
+	}
+
+	if i, ok := c.GetInt("integer-value"); !(ok && i == 36) {
+		t.Errorf("expected=%v, got=%v", 36, i)
+	}
+	if f, ok := c.GetFloat("float-value"); !(ok && f == 3.14) {
+		t.Errorf("expected=%v, got=%v", 3.14, f)
+	}
+	if b, ok := c.GetBool("boolean-value"); !(ok && b) {
+		t.Errorf("expected=%v, got=%v", true, b)
+	}
+	if size, ok := c.GetListSize("servers"); !(ok && size == 2) {
+		t.Errorf("expected=%v, got=%v", 2, size)
+	}
+	if keys, ok := c.GetMapKeys("some-config.address"); !(ok && strings.Join(keys, ",") == "ip,port") {
+		t.Errorf("expected=%v, got=%v", "ip,port", keys)
+	}
+}
+
+func TestDecodeProperties(t *testing.T) {
+	config, err := decodeProperties([]byte("list[1]=b\nlist[0]=a\nkey=1\nkey=2\r\nmatrix[0][1]=x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := lookupFileConfig(config, "list[0]"); v != "a" {
+		t.Errorf("expected=%v, got=%v", "a", v)
+	}
+	if v := lookupFileConfig(config, "key"); v != "2" {
+		t.Errorf("expected=%v, got=%v", "2", v)
+	}
+	if v := lookupFileConfig(config, "matrix[0][1]"); v != "x" {
+		t.Errorf("expected=%v, got=%v", "x", v)
+	}
+
+	invalid := []string{
+		"a..b=1",
+		"[0]=1",
+		"list[0]=1\nlist.a=2",
+		`a=\u12`,
+		`a=\uzzzz`,
+		"list[4000000000]=x",
+		"list[0]=1\nlist[2000]=2",
+	}
+	for _, data := range invalid {
+		if _, err := decodeProperties([]byte(data)); err == nil {
+			t.Errorf("expected error for %q", data)
+		}
+	}
+}
+
+func TestDecodePropertiesNodeValues(t *testing.T) {
+	data := []string{
+		"logging.level=INFO\nlogging.level.com.foo=DEBUG",
+		"logging.level.com.foo=DEBUG\nlogging.level=INFO",
+	}
+	for _, d := range data {
+		config, err := decodeProperties([]byte(d))
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", d, err)
+		}
+		source := &fileConfigSource{config: config}
+
+		if v := source.Get("logging.level"); v != "INFO" {
+			t.Errorf("expected=%v, got=%v", "INFO", v)
+		}
+		if v := source.Get("logging.level.com.foo"); v != "DEBUG" {
+			t.Errorf("expected=%v, got=%v", "DEBUG", v)
+		}
+		if keys := childKeys(source.Keys("logging"), "logging"); strings.Join(keys, ",") != "level" {
+			t.Errorf("expected=%v, got=%v", "level", keys)
+		}
+		keys := source.Keys("logging.level")
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != "logging.level,logging.level.com.foo" {
+			t.Errorf("expected=%v, got=%v", "logging.level,logging.level.com.foo", keys)
+		}
+		if keys := source.mapKeys("logging.level"); strings.Join(keys, ",") != "com" {
+			t.Errorf("expected=%v, got=%v", "com", keys)
+		}
+	}
+
+	// lists can't have values of their own
+	if _, err := decodeProperties([]byte("list=1\nlist[0]=2")); err == nil {
+		t.Error("expected error for a list with a value")
+	}
+
+	// indices can be defined in any order
+	config, err := decodeProperties([]byte("list[1024]=x\nlist[0]=a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := config["list"].([]interface{}); !ok || len(l) != 1025 {
+		t.Errorf("expected a list with 1025 elements, got=%v", config["list"])
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"github.com/BurntSushi/toml"
+)
+
+// decodeTOML decodes a TOML file. Types of values are preserved: integers are decoded as int64,
+// floats as float64, booleans as bool and dates and times as time.Time.
+func decodeTOML(data []byte) (map[string]interface{}, error) {
+	var config map[string]interface{}
+	if _, err := toml.Decode(string(data), &config); err != nil {
+		return nil, err
+	}
+	return normalizeTOML(config).(map[string]interface{}), nil
+}
+
+// normalizeTOML converts arrays of tables, which are decoded as []map[string]interface{}, to
+// []interface{}, so that they can be walked like lists from other file formats
+func normalizeTOML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = normalizeTOML(child)
+		}
+		return v
+	case []map[string]interface{}:
+		l := make([]interface{}, len(v))
+		for i, child := range v {
+			l[i] = normalizeTOML(child)
+		}
+		return l
+	case []interface{}:
+		for i, child := range v {
+			v[i] = normalizeTOML(child)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOMLConfigFile(t *testing.T) {
+	c, err := NewUtilE(Options{
+		ConfigPath: "../test/config.toml",
+		LogLevel:   100, // turn off logging
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, ok := c.GetString("string-value"); !(ok && s == "Hello world") {
+		t.Errorf("expected=%v, got=%v", "Hello world", s)
+	}
+	if i, ok := c.Get("integer-value").(int64); !(ok && i == 36) {
+		t.Errorf("expected=%v, got=%#v", int64(36), c.Get("integer-value"))
+	}
+	if i, ok := c.Get("large-integer").(int64); !(ok && i == 9007199254740993) {
+		t.Errorf("expected=%v, got=%#v", int64(9007199254740993), c.Get("large-integer"))
+	}
+	if i, ok := c.GetInt("large-integer"); !(ok && i == 9007199254740993) {
+		t.Errorf("expected=%v, got=%v", 9007199254740993, i)
+	}
+	if i, ok := c.GetInt("integer-value"); !(ok && i == 36) {
+		t.Errorf("expected=%v, got=%v", 36, i)
+	}
+	if f, ok := c.GetFloat("float-value"); !(ok && f == 3.14) {
+		t.Errorf("expected=%v, got=%v", 3.14, f)
+	}
+	if b, ok := c.GetBool("boolean-value"); !(ok && b) {
+		t.Errorf("expected=%v, got=%v", true, b)
+	}
+	released := time.Date(2019, 5, 27, 7, 32, 0, 0, time.UTC)
+	if d, ok := c.Get("released").(time.Time); !(ok && d.Equal(released)) {
+		t.Errorf("expected=%v, got=%#v", released, c.Get("released"))
+	}
+
+	if i, ok := c.GetInt("ports[1]"); !(ok && i == 8081) {
+		t.Errorf("expected=%v, got=%v", 8081, i)
+	}
+	if s, ok := c.GetString("some-config.address.ip"); !(ok && s == "127.0.0.2") {
+		t.Errorf("expected=%v, got=%v", "127.0.0.2", s)
+	}
+
+	// arrays of tables
+	if size, ok := c.GetListSize("servers"); !(ok && size == 2) {
+		t.Errorf("expected=%v, got=%v", 2, size)
+	}
+	if s, ok := c.GetString("servers[1].host"); !(ok && s == "example.com") {
+		t.Errorf("expected=%v, got=%v", "example.com", s)
+	}
+	if s, ok := c.GetString("servers[1].tags[1]"); !(ok && s == "canary") {
+		t.Errorf("expected=%v, got=%v", "canary", s)
+	}
+
+	var large struct {
+		LargeInteger int64 `config:"large-integer"`
+	}
+	NewBundle("", &large, Options{
+		ConfigPath: "../test/config.toml",
+		LogLevel:   100, // turn off logging
+	})
+	if large.LargeInteger != 9007199254740993 {
+		t.Errorf("expected=%v, got=%v", 9007199254740993, large.LargeInteger)
+	}
+
+	type server struct {
+		Host string
+		Port int
+		Tags []string
+	}
+	var bundle struct {
+		Servers []server
+	}
+	NewBundle("", &bundle, Options{
+		ConfigPath: "../test/config.toml",
+		LogLevel:   100, // turn off logging
+	})
+	if len(bundle.Servers) != 2 || bundle.Servers[1].Port != 8081 || len(bundle.Servers[1].Tags) != 2 {
+		t.Errorf("expected servers to be set, got=%+v", bundle.Servers)
+	}
+}
+
+func TestDecodeTOMLError(t *testing.T) {
+	if _, err := decodeTOML([]byte("a = ")); err == nil {
+		t.Error("expected error for invalid TOML")
+	}
+}
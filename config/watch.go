@@ -0,0 +1,119 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ChangeEvent describes a change of a watched key's effective value, created with
+// Util.SubscribeEvent. Values of keys, that are prefixes of other keys (i.e. lists or maps in
+// Consul and etcd), are empty, as only keys under them change.
+type ChangeEvent struct {
+	// Key is the watched key.
+	Key string
+	// OldValue is the previous value of the key, or an empty string if key did not exist.
+	OldValue string
+	// NewValue is the new value of the key, or an empty string if key was deleted.
+	NewValue string
+	// Source is the name of the configuration source providing the new value. If key was deleted,
+	// it is the name of the source, in which it was deleted.
+	Source string
+	// Deleted is true if key does not exist in any configuration source anymore.
+	Deleted bool
+	// Time is the time the change was detected at.
+	Time time.Time
+}
+
+// eventWatch keeps the last effective value of a watched key and fires the callback with a
+// ChangeEvent whenever it changes
+type eventWatch struct {
+	util     Util
+	key      string
+	callback func(event ChangeEvent)
+
+	mu      sync.Mutex
+	value   interface{}
+	subtree map[string]interface{}
+}
+
+func newEventWatch(util Util, key string, callback func(event ChangeEvent)) *eventWatch {
+	w := &eventWatch{
+		util:     util,
+		key:      key,
+		callback: callback,
+	}
+	w.value, _, w.subtree = w.lookup()
+	return w
+}
+
+// lookup returns the effective value of the watched key and the configuration source it was found
+// in. Keys without a value can be prefixes of other keys (i.e. lists or maps in Consul), so
+// effective values of all keys under them are returned instead, to detect changes in the subtree.
+func (w *eventWatch) lookup() (value interface{}, source ConfigSource, subtree map[string]interface{}) {
+	raw, source := w.util.lookup(w.key)
+	if raw != nil {
+		return w.util.resolve(w.key, raw), source, nil
+	}
+
+	keys := w.util.Keys(w.key)
+	if len(keys) == 0 {
+		return nil, nil, nil
+	}
+	subtree = make(map[string]interface{}, len(keys))
+	for _, k := range keys {
+		subtree[k] = w.util.Get(k)
+	}
+	return nil, nil, subtree
+}
+
+// changed is called when the value of the watched key (or a key referenced in it) has changed in
+// a given configuration source. Callback is fired, if the effective value has changed as well.
+func (w *eventWatch) changed(cs ConfigSource) {
+	// changes are processed one at a time, so events are delivered in order
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	value, source, subtree := w.lookup()
+	if reflect.DeepEqual(value, w.value) && reflect.DeepEqual(subtree, w.subtree) {
+		return
+	}
+
+	event := ChangeEvent{
+		Key:      w.key,
+		OldValue: valueString(w.value),
+		NewValue: valueString(value),
+		Deleted:  value == nil && subtree == nil,
+		Time:     time.Now(),
+	}
+	if source != nil {
+		event.Source = source.Name()
+	} else {
+		event.Source = cs.Name()
+	}
+	w.value = value
+	w.subtree = subtree
+
+	w.callback(event)
+}
@@ -0,0 +1,153 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSubscribeEvent(t *testing.T) {
+	os.Setenv("EVENT_OVERRIDDEN", "from env")
+	defer os.Unsetenv("EVENT_OVERRIDDEN")
+
+	stub := newConsulStub(map[string]string{
+		"test/event/key":        "a",
+		"test/event/overridden": "a",
+	})
+	defer stub.server.Close()
+
+	c := NewUtil(consulStubOptions(stub))
+	defer c.Close()
+
+	events := make(chan ChangeEvent, 10)
+	c.SubscribeEvent("event.key", func(event ChangeEvent) {
+		events <- event
+	})
+	c.SubscribeEvent("event.overridden", func(event ChangeEvent) {
+		events <- event
+	})
+
+	expectEvent := func(expected ChangeEvent) {
+		select {
+		case e := <-events:
+			if e.Time.IsZero() {
+				t.Errorf("event time is not set")
+			}
+			e.Time = time.Time{}
+			if e != expected {
+				t.Errorf("expected=%+v, got=%+v", expected, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch was not fired")
+		}
+	}
+
+	// value of event.overridden is overridden by environment variable, no event is fired
+	stub.set("test/event/overridden", "b", false)
+	stub.set("test/event/key", "b", false)
+	expectEvent(ChangeEvent{Key: "event.key", OldValue: "a", NewValue: "b", Source: "consul"})
+
+	// empty value is not a deletion
+	stub.set("test/event/key", "", false)
+	expectEvent(ChangeEvent{Key: "event.key", OldValue: "b", NewValue: "", Source: "consul"})
+
+	stub.set("test/event/key", "", true)
+	expectEvent(ChangeEvent{Key: "event.key", OldValue: "", NewValue: "", Source: "consul", Deleted: true})
+
+	stub.set("test/event/key", "c", false)
+	expectEvent(ChangeEvent{Key: "event.key", OldValue: "", NewValue: "c", Source: "consul"})
+
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSubscribePrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kumuluzee-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("other: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stub := newConsulStub(map[string]string{
+		"test/precedence/key": "consul 1",
+	})
+	defer stub.server.Close()
+
+	options := consulStubOptions(stub)
+	options.ConfigPath = path
+	// file outranks Consul
+	options.Ordinals = map[string]int{"file": 200}
+
+	c := NewUtil(options)
+	defer c.Close()
+
+	updates := make(chan string, 10)
+	c.Subscribe("precedence.key", func(key string, value string) {
+		updates <- key + "=" + value
+	})
+
+	expectUpdate := func(expected string) {
+		select {
+		case u := <-updates:
+			if u != expected {
+				t.Errorf("expected=%v, got=%v", expected, u)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch was not fired")
+		}
+	}
+
+	stub.set("test/precedence/key", "consul 2", false)
+	expectUpdate("precedence.key=consul 2")
+
+	// higher priority source gains the key
+	if err := ioutil.WriteFile(path, []byte("precedence:\n  key: file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate("precedence.key=file")
+
+	// overridden value changes
+	stub.set("test/precedence/key", "consul 3", false)
+	select {
+	case u := <-updates:
+		t.Errorf("unexpected update %s", u)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// higher priority source loses the key
+	if err := ioutil.WriteFile(path, []byte("other: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate("precedence.key=consul 3")
+}